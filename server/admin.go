@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ije/rex"
+)
+
+// the bearer token of the admin API, the admin API is disabled if it's empty
+var adminToken string
+
+// checkAdminAuth checks the `Authorization: Bearer <token>` header of the admin API request
+func checkAdminAuth(ctx *rex.Context) bool {
+	auth := ctx.R.Header.Get("Authorization")
+	if adminToken == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// serveAdmin serves the admin API under `/_admin/`, the npm package names can't start with `_`
+func serveAdmin(ctx *rex.Context, pathname string) interface{} {
+	if adminToken == "" {
+		return rex.Status(404, "not found")
+	}
+	if !checkAdminAuth(ctx) {
+		ctx.SetHeader("WWW-Authenticate", `Bearer realm="esm.sh admin"`)
+		return rex.Status(401, "unauthorized")
+	}
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+
+	// rex only routes the GET and POST requests, the actions are POST requests
+	method := http.MethodGet
+	switch pathname {
+	case "/_admin/queue/pause", "/_admin/queue/resume", "/_admin/queue/max-processes",
+		"/_admin/tasks/cancel", "/_admin/tasks/bump", "/_admin/failures/clear", "/_admin/verifications/clear":
+		method = http.MethodPost
+	}
+	if ctx.R.Method != method {
+		ctx.SetHeader("Allow", method)
+		return rex.Status(405, "method not allowed")
+	}
+
+	switch pathname {
+	case "/_admin/queue":
+		return buildQueue.summary()
+
+	case "/_admin/queue/pause":
+		buildQueue.Pause()
+		return buildQueue.summary()
+
+	case "/_admin/queue/resume":
+		buildQueue.Resume()
+		return buildQueue.summary()
+
+	case "/_admin/queue/max-processes":
+		n, err := strconv.Atoi(ctx.Form.Value("n"))
+		if err != nil || n < 1 {
+			return rex.Status(400, "Invalid n query")
+		}
+		buildQueue.SetMaxProcesses(n)
+		return buildQueue.summary()
+
+	case "/_admin/tasks":
+		return map[string]interface{}{"tasks": buildQueue.listTasks()}
+
+	case "/_admin/tasks/cancel", "/_admin/tasks/bump":
+		id := ctx.Form.Value("id")
+		if id == "" {
+			return rex.Status(400, "Missing id query")
+		}
+		ok := false
+		if pathname == "/_admin/tasks/cancel" {
+			ok = buildQueue.Cancel(id)
+		} else {
+			ok = buildQueue.Bump(id)
+		}
+		if !ok {
+			return rex.Status(404, "Task not found")
+		}
+		return map[string]interface{}{"ok": true}
+
+	case "/_admin/failures":
+		list, err := listBuildFailures()
+		if err != nil {
+			return rex.Status(500, err.Error())
+		}
+		return map[string]interface{}{"failures": list}
+
+	case "/_admin/failures/clear":
+		// clear the failure record of the `?id` build, or all records
+		ids := []string{}
+		if id := ctx.Form.Value("id"); id != "" {
+			ids = append(ids, id)
+		} else {
+			list, err := listBuildFailures()
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			for _, f := range list {
+				ids = append(ids, f.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := clearBuildFailure(id); err != nil {
+				return rex.Status(500, err.Error())
+			}
+		}
+		return map[string]interface{}{"cleared": len(ids)}
+
+	case "/_admin/verifications/clear":
+		// the build is served again without the verification result
+		id := ctx.Form.Value("id")
+		if id == "" {
+			return rex.Status(400, "Missing id query")
+		}
+		ok, err := clearVerification(id)
+		if err != nil {
+			return rex.Status(500, err.Error())
+		}
+		if !ok {
+			return rex.Status(404, "Build not found")
+		}
+		return map[string]interface{}{"ok": true}
+	}
+	return rex.Status(404, "not found")
+}
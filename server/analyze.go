@@ -0,0 +1,174 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// esbuildMetafile defines the metafile generated by esbuild,
+// see https://esbuild.github.io/api/#metafile
+type esbuildMetafile struct {
+	Inputs map[string]struct {
+		Bytes int `json:"bytes"`
+	} `json:"inputs"`
+	Outputs map[string]struct {
+		Bytes   int `json:"bytes"`
+		Imports []struct {
+			Path string `json:"path"`
+		} `json:"imports"`
+		Inputs map[string]struct {
+			BytesInOutput int `json:"bytesInOutput"`
+		} `json:"inputs"`
+	} `json:"outputs"`
+}
+
+// BuildReport defines the size and composition report of a build
+type BuildReport struct {
+	ID        string               `json:"id"`
+	Pkg       string               `json:"pkg"`
+	Bytes     int64                `json:"bytes"`
+	GzipBytes int64                `json:"gzipBytes"`
+	Packages  []BuildReportPackage `json:"packages"`
+	Inputs    []BuildReportInput   `json:"inputs"`
+}
+
+type BuildReportPackage struct {
+	Name          string  `json:"name"`
+	Files         int     `json:"files"`
+	BytesInOutput int     `json:"bytesInOutput"`
+	Percent       float64 `json:"percent"`
+	Bundled       bool    `json:"bundled"`
+}
+
+type BuildReportInput struct {
+	Path          string `json:"path"`
+	Package       string `json:"package"`
+	Bytes         int    `json:"bytes"`
+	BytesInOutput int    `json:"bytesInOutput"`
+}
+
+func getMetafilePath(id string) string {
+	return path.Join("builds", strings.TrimSuffix(id, ".js")+".meta.json")
+}
+
+// analyzeBuild reports the size and composition of the build, the entries of a splitting build
+// share the metafile of the build that is stored with the `metafileID`.
+func analyzeBuild(id string, metafileID string, pkg Pkg) (report *BuildReport, err error) {
+	savePath := path.Join("builds", id)
+	_, size, _, err := fs.Exists(savePath)
+	if err != nil {
+		return
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	cw := &countWriter{}
+	gw, err := gzip.NewWriterLevel(cw, gzip.DefaultCompression)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(gw, r)
+	if err != nil {
+		return
+	}
+	gw.Close()
+
+	report = &BuildReport{
+		ID:        id,
+		Pkg:       pkg.String(),
+		Bytes:     size,
+		GzipBytes: cw.n,
+		Packages:  []BuildReportPackage{},
+		Inputs:    []BuildReportInput{},
+	}
+
+	// the builds of the previous version don't have the metafile
+	metafilePath := getMetafilePath(metafileID)
+	exists, size, _, err := fs.Exists(metafilePath)
+	if err != nil || !exists {
+		return
+	}
+	mr, err := fs.ReadFile(metafilePath, size)
+	if err != nil {
+		return
+	}
+	defer mr.Close()
+	data, err := ioutil.ReadAll(mr)
+	if err != nil {
+		return
+	}
+	var meta esbuildMetafile
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return
+	}
+
+	packages := map[string]*BuildReportPackage{}
+	total := 0
+	for outputPath, output := range meta.Outputs {
+		if !strings.HasSuffix(outputPath, ".js") {
+			continue
+		}
+		for inputPath, input := range output.Inputs {
+			pkgName := getInputPackageName(inputPath, pkg.Name)
+			report.Inputs = append(report.Inputs, BuildReportInput{
+				Path:          inputPath,
+				Package:       pkgName,
+				Bytes:         meta.Inputs[inputPath].Bytes,
+				BytesInOutput: input.BytesInOutput,
+			})
+			p, ok := packages[pkgName]
+			if !ok {
+				p = &BuildReportPackage{Name: pkgName, Bundled: pkgName != pkg.Name}
+				packages[pkgName] = p
+			}
+			p.Files++
+			p.BytesInOutput += input.BytesInOutput
+			total += input.BytesInOutput
+		}
+	}
+	for _, p := range packages {
+		if total > 0 {
+			p.Percent = float64(p.BytesInOutput*10000/total) / 100
+		}
+		report.Packages = append(report.Packages, *p)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].BytesInOutput > report.Packages[j].BytesInOutput
+	})
+	sort.Slice(report.Inputs, func(i, j int) bool {
+		return report.Inputs[i].BytesInOutput > report.Inputs[j].BytesInOutput
+	})
+	return
+}
+
+// getInputPackageName returns the package name of an input file of the metafile,
+// the file that is not in `node_modules` belongs to the entry package.
+func getInputPackageName(inputPath string, entryPkgName string) string {
+	i := strings.LastIndex(inputPath, "node_modules/")
+	if i < 0 {
+		return entryPkgName
+	}
+	a := strings.Split(inputPath[i+len("node_modules/"):], "/")
+	if strings.HasPrefix(a[0], "@") && len(a) > 1 {
+		return a[0] + "/" + a[1]
+	}
+	return a[0]
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"github.com/ije/esbuild-internal/js_ast"
+)
+
+// astVisitor walks the statements and expressions of the parsed JS code, the `expr` callback
+// is called for each expression and returns false to skip the children of the expression.
+type astVisitor struct {
+	expr func(expr js_ast.Expr) bool
+}
+
+func (v *astVisitor) visitStmts(stmts []js_ast.Stmt) {
+	for _, stmt := range stmts {
+		v.visitStmt(stmt)
+	}
+}
+
+func (v *astVisitor) visitStmt(stmt js_ast.Stmt) {
+	switch s := stmt.Data.(type) {
+	case *js_ast.SBlock:
+		v.visitStmts(s.Stmts)
+	case *js_ast.SExportDefault:
+		v.visitStmt(s.Value)
+	case *js_ast.SExportEquals:
+		v.visitExpr(s.Value)
+	case *js_ast.SLazyExport:
+		v.visitExpr(s.Value)
+	case *js_ast.SExpr:
+		v.visitExpr(s.Value)
+	case *js_ast.SEnum:
+		for _, value := range s.Values {
+			v.visitExpr(value.ValueOrNil)
+		}
+	case *js_ast.SNamespace:
+		v.visitStmts(s.Stmts)
+	case *js_ast.SFunction:
+		v.visitFn(s.Fn)
+	case *js_ast.SClass:
+		v.visitClass(s.Class)
+	case *js_ast.SLabel:
+		v.visitStmt(s.Stmt)
+	case *js_ast.SIf:
+		v.visitExpr(s.Test)
+		v.visitStmt(s.Yes)
+		v.visitStmt(s.NoOrNil)
+	case *js_ast.SFor:
+		v.visitStmt(s.InitOrNil)
+		v.visitExpr(s.TestOrNil)
+		v.visitExpr(s.UpdateOrNil)
+		v.visitStmt(s.Body)
+	case *js_ast.SForIn:
+		v.visitStmt(s.Init)
+		v.visitExpr(s.Value)
+		v.visitStmt(s.Body)
+	case *js_ast.SForOf:
+		v.visitStmt(s.Init)
+		v.visitExpr(s.Value)
+		v.visitStmt(s.Body)
+	case *js_ast.SDoWhile:
+		v.visitStmt(s.Body)
+		v.visitExpr(s.Test)
+	case *js_ast.SWhile:
+		v.visitExpr(s.Test)
+		v.visitStmt(s.Body)
+	case *js_ast.SWith:
+		v.visitExpr(s.Value)
+		v.visitStmt(s.Body)
+	case *js_ast.STry:
+		v.visitStmts(s.Block.Stmts)
+		if s.Catch != nil {
+			v.visitBinding(s.Catch.BindingOrNil)
+			v.visitStmts(s.Catch.Block.Stmts)
+		}
+		if s.Finally != nil {
+			v.visitStmts(s.Finally.Block.Stmts)
+		}
+	case *js_ast.SSwitch:
+		v.visitExpr(s.Test)
+		for _, c := range s.Cases {
+			v.visitExpr(c.ValueOrNil)
+			v.visitStmts(c.Body)
+		}
+	case *js_ast.SReturn:
+		v.visitExpr(s.ValueOrNil)
+	case *js_ast.SThrow:
+		v.visitExpr(s.Value)
+	case *js_ast.SLocal:
+		for _, decl := range s.Decls {
+			v.visitBinding(decl.Binding)
+			v.visitExpr(decl.ValueOrNil)
+		}
+	}
+}
+
+func (v *astVisitor) visitExprs(exprs []js_ast.Expr) {
+	for _, expr := range exprs {
+		v.visitExpr(expr)
+	}
+}
+
+func (v *astVisitor) visitExpr(expr js_ast.Expr) {
+	if expr.Data == nil || !v.expr(expr) {
+		return
+	}
+	switch e := expr.Data.(type) {
+	case *js_ast.EArray:
+		v.visitExprs(e.Items)
+	case *js_ast.EUnary:
+		v.visitExpr(e.Value)
+	case *js_ast.EBinary:
+		v.visitExpr(e.Left)
+		v.visitExpr(e.Right)
+	case *js_ast.ENew:
+		v.visitExpr(e.Target)
+		v.visitExprs(e.Args)
+	case *js_ast.ECall:
+		v.visitExpr(e.Target)
+		v.visitExprs(e.Args)
+	case *js_ast.EDot:
+		v.visitExpr(e.Target)
+	case *js_ast.EIndex:
+		v.visitExpr(e.Target)
+		v.visitExpr(e.Index)
+	case *js_ast.EArrow:
+		v.visitArgs(e.Args)
+		v.visitStmts(e.Body.Block.Stmts)
+	case *js_ast.EFunction:
+		v.visitFn(e.Fn)
+	case *js_ast.EClass:
+		v.visitClass(e.Class)
+	case *js_ast.EJSXElement:
+		v.visitExpr(e.TagOrNil)
+		v.visitProperties(e.Properties)
+		v.visitExprs(e.Children)
+	case *js_ast.EObject:
+		v.visitProperties(e.Properties)
+	case *js_ast.ESpread:
+		v.visitExpr(e.Value)
+	case *js_ast.ETemplate:
+		v.visitExpr(e.TagOrNil)
+		for _, part := range e.Parts {
+			v.visitExpr(part.Value)
+		}
+	case *js_ast.EAwait:
+		v.visitExpr(e.Value)
+	case *js_ast.EYield:
+		v.visitExpr(e.ValueOrNil)
+	case *js_ast.EIf:
+		v.visitExpr(e.Test)
+		v.visitExpr(e.Yes)
+		v.visitExpr(e.No)
+	case *js_ast.EImportCall:
+		v.visitExpr(e.Expr)
+		v.visitExpr(e.OptionsOrNil)
+	}
+}
+
+func (v *astVisitor) visitFn(fn js_ast.Fn) {
+	v.visitArgs(fn.Args)
+	v.visitStmts(fn.Body.Block.Stmts)
+}
+
+func (v *astVisitor) visitArgs(args []js_ast.Arg) {
+	for _, arg := range args {
+		v.visitBinding(arg.Binding)
+		v.visitExpr(arg.DefaultOrNil)
+	}
+}
+
+func (v *astVisitor) visitClass(class js_ast.Class) {
+	v.visitExpr(class.ExtendsOrNil)
+	v.visitProperties(class.Properties)
+}
+
+func (v *astVisitor) visitProperties(properties []js_ast.Property) {
+	for _, p := range properties {
+		if p.ClassStaticBlock != nil {
+			v.visitStmts(p.ClassStaticBlock.Block.Stmts)
+		}
+		if p.IsComputed {
+			v.visitExpr(p.Key)
+		}
+		v.visitExpr(p.ValueOrNil)
+		v.visitExpr(p.InitializerOrNil)
+	}
+}
+
+func (v *astVisitor) visitBinding(binding js_ast.Binding) {
+	switch b := binding.Data.(type) {
+	case *js_ast.BArray:
+		for _, item := range b.Items {
+			v.visitBinding(item.Binding)
+			v.visitExpr(item.DefaultValueOrNil)
+		}
+	case *js_ast.BObject:
+		for _, p := range b.Properties {
+			if p.IsComputed {
+				v.visitExpr(p.Key)
+			}
+			v.visitBinding(p.Value)
+			v.visitExpr(p.DefaultValueOrNil)
+		}
+	}
+}
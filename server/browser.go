@@ -0,0 +1,70 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// isBrowserTarget checks whether the `browser` field of package.json applies to the build target
+func isBrowserTarget(target string) bool {
+	return target != "node" && target != "deno" && target != "types"
+}
+
+// lookupBrowserMap looks up the module in the object form of the `browser` field, the value is
+// either a replacement path/package or `false` for an empty module. The local module path is
+// matched with the `.js` extension and the `/index.js` suffix.
+// see https://github.com/defunctzombie/package-browser-field-spec
+func lookupBrowserMap(browser interface{}, module string) (value interface{}, ok bool) {
+	m, isMap := browser.(map[string]interface{})
+	if !isMap {
+		return
+	}
+	if !isLocalImport(module) {
+		value, ok = m[module]
+		return
+	}
+	module = "./" + strings.TrimPrefix(path.Clean(module), "./")
+	candidates := []string{module, module + ".js", module + "/index.js"}
+	if strings.HasSuffix(module, ".js") {
+		candidates = append(candidates, strings.TrimSuffix(module, ".js"))
+	}
+	for _, key := range candidates {
+		for k, v := range m {
+			if isLocalImport(k) && "./"+strings.TrimPrefix(path.Clean(k), "./") == key {
+				return v, true
+			}
+		}
+	}
+	return
+}
+
+// resolveBrowserEntries replaces the entries of the package with the browser versions, the
+// string form of the `browser` field replaces the `main` entry if `replaceMain` is true.
+func resolveBrowserEntries(p *NpmPackage, replaceMain bool) {
+	switch v := p.Browser.(type) {
+	case string:
+		if replaceMain && v != "" {
+			p.Main = v
+		}
+	case map[string]interface{}:
+		if p.Module != "" {
+			if s, ok := lookupBrowserMapString(v, p.Module); ok {
+				p.Module = s
+			}
+		}
+		if p.Main != "" {
+			if s, ok := lookupBrowserMapString(v, p.Main); ok {
+				p.Main = s
+			}
+		}
+	}
+}
+
+func lookupBrowserMapString(browser map[string]interface{}, module string) (string, bool) {
+	value, ok := lookupBrowserMap(browser, "./"+strings.TrimPrefix(module, "./"))
+	if ok {
+		s, ok := value.(string)
+		return s, ok && s != ""
+	}
+	return "", false
+}
@@ -9,7 +9,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"reflect"
 	"strings"
 	"time"
 
@@ -17,9 +16,20 @@ import (
 
 	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/crypto/rs"
-	"github.com/ije/gox/utils"
 )
 
+// the assets are inlined as data URLs
+var dataURLLoaders = map[string]api.Loader{
+	".wasm":  api.LoaderDataURL,
+	".svg":   api.LoaderDataURL,
+	".png":   api.LoaderDataURL,
+	".webp":  api.LoaderDataURL,
+	".ttf":   api.LoaderDataURL,
+	".eot":   api.LoaderDataURL,
+	".woff":  api.LoaderDataURL,
+	".woff2": api.LoaderDataURL,
+}
+
 type BuildTask struct {
 	CdnOrigin         string            `json:"cdnOrigin"`
 	BuildVersion      int               `json:"buildVersion"`
@@ -32,11 +42,21 @@ type BuildTask struct {
 	NoRequire         bool              `json:"noRequire"`
 	KeepNames         bool              `json:"keepNames"`
 	IgnoreAnnotations bool              `json:"ignoreAnnotations"`
+	Exports           []string          `json:"exports"`
+	Entries           PkgSlice          `json:"entries"`
+	Splitting         bool              `json:"splitting"`
+	Before            time.Time         `json:"before"`
+	Conditions        []string          `json:"conditions"`
+	Polyfills         string            `json:"polyfills"`
 
 	// state
-	id    string
-	wd    string
-	stage string
+	id       string
+	wd       string
+	stage    string
+	lock     *BuildLock
+	buildLog *BuildLog
+	// the identity suffix of the requested build ID if it differs from the current one
+	identity *string
 }
 
 func (task *BuildTask) ID() string {
@@ -44,6 +64,11 @@ func (task *BuildTask) ID() string {
 		return task.id
 	}
 
+	if len(task.Entries) > 0 {
+		task.id = path.Join(task.getBundleDir(), "importmap.json")
+		return task.id
+	}
+
 	pkg := task.Pkg
 	name := path.Base(pkg.Name)
 
@@ -51,6 +76,12 @@ func (task *BuildTask) ID() string {
 		name = pkg.Submodule
 	}
 	name = strings.TrimSuffix(name, ".js")
+	if len(task.Exports) > 0 {
+		name += ".e-" + btoaUrl(strings.Join(task.Exports, ","))
+	}
+	if len(task.Conditions) > 0 {
+		name += ".c-" + btoaUrl(strings.Join(task.Conditions, ","))
+	}
 	if task.NoRequire {
 		name += ".nr"
 	}
@@ -60,37 +91,93 @@ func (task *BuildTask) ID() string {
 	if task.IgnoreAnnotations {
 		name += ".ia"
 	}
+	if task.Polyfills != "" {
+		name += ".pf-" + task.Polyfills
+	}
+	if !task.Before.IsZero() {
+		name += fmt.Sprintf(".b-%d", task.Before.Unix())
+	}
+	if task.identity != nil {
+		name += *task.identity
+	} else {
+		name += getIdentitySuffix(pkg, task.Target, task.BundleMode)
+	}
 	if task.DevMode {
 		name += ".development"
 	}
 	if task.BundleMode {
 		name += ".bundle"
 	}
+	if task.Splitting {
+		name += ".split"
+	}
 
-	task.id = fmt.Sprintf(
-		"v%d/%s@%s/%s%s/%s.js",
+	task.id = fmt.Sprintf("%s/%s.js", task.getBuildDir(), name)
+	if task.Target == "types" {
+		task.id = strings.TrimSuffix(task.id, ".js")
+	}
+	return task.id
+}
+
+// getBuildDir returns the storage dir of the package builds for the task target
+func (task *BuildTask) getBuildDir() string {
+	return fmt.Sprintf(
+		"v%d/%s@%s/%s%s",
 		task.BuildVersion,
-		pkg.Name,
-		pkg.Version,
+		task.Pkg.Name,
+		task.Pkg.Version,
 		encodeAliasDepsPrefix(task.Alias, task.Deps),
 		task.Target,
-		name,
 	)
-	if task.Target == "types" {
-		task.id = strings.TrimSuffix(task.id, ".js")
+}
+
+// getIdentitySuffix returns the part of the build ID that identifies the server state the build
+// depends on: the build plugins, the overrides, the substitutions and the polyfill table. The
+// bundle builds depend on the overrides of all packages since the dependencies are bundled.
+func getIdentitySuffix(pkg Pkg, target string, bundleMode bool) string {
+	suffix := ""
+	if id := getBuildPluginsID(); id != "" {
+		suffix += ".p-" + id
 	}
-	return task.id
+	if bundleMode {
+		if id := getOverridesID("", ""); id != "" {
+			suffix += ".o-" + id
+		}
+	} else if id := getOverridesID(pkg.Name, pkg.Version); id != "" {
+		suffix += ".o-" + id
+	}
+	if id := getSubstitutionsID(target); id != "" {
+		suffix += ".s-" + id
+	}
+	if id := getPolyfillsID(target); id != "" {
+		suffix += ".pt-" + id
+	}
+	return suffix
 }
 
-func (task *BuildTask) getImportPath(pkg Pkg, prefix string) string {
+// getImportPath returns the import path of the dependency build
+func (task *BuildTask) getImportPath(pkg Pkg, prefix string, bundleMode bool) string {
 	name := path.Base(pkg.Name)
 	if pkg.Submodule != "" {
 		name = pkg.Submodule
 	}
 	name = strings.TrimSuffix(name, ".js")
+	if len(task.Conditions) > 0 {
+		name += ".c-" + btoaUrl(strings.Join(task.Conditions, ","))
+	}
+	if task.Polyfills != "" {
+		name += ".pf-" + task.Polyfills
+	}
+	if !task.Before.IsZero() {
+		name += fmt.Sprintf(".b-%d", task.Before.Unix())
+	}
+	name += getIdentitySuffix(pkg, task.Target, bundleMode)
 	if task.DevMode {
 		name += ".development"
 	}
+	if bundleMode {
+		name += ".bundle"
+	}
 
 	return fmt.Sprintf(
 		"%s/v%d/%s@%s/%s%s/%s.js",
@@ -123,9 +210,32 @@ func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
 		}
 	}()
 
-	task.stage = "install"
+	task.buildLog = newBuildLog(task.ID())
+	defer func() {
+		err = asBuildError(err)
+		task.storeBuildLog(err)
+	}()
+
+	// reuse the dependency resolution of the previous build
+	task.lock = findBuildLock(task.ID())
+
+	if len(task.Entries) > 0 {
+		return task.buildBundle()
+	}
+
+	task.setStage("install")
+	installSpec, err := getInstallSpec(task.Pkg)
+	if err != nil {
+		return
+	}
+	if !task.Before.IsZero() && !regSourceVersion.MatchString(task.Pkg.Version) {
+		err = pinYarnResolutions(task.wd, task.Pkg.Name, task.Pkg.Version, task.Before)
+		if err != nil {
+			return
+		}
+	}
 	for i := 0; i < 3; i++ {
-		err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", task.Pkg.Name, task.Pkg.Version))
+		err = task.yarnAdd(installSpec)
 		if err == nil && !fileExists(path.Join(task.wd, "node_modules", task.Pkg.Name, "package.json")) {
 			defer yarnCacheClean(task.wd, task.Pkg.Name)
 			err = fmt.Errorf("yarnAdd(%s): package.json not found", task.Pkg)
@@ -134,6 +244,7 @@ func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
 			break
 		}
 		if i < 2 {
+			task.logf("retry", "install %s: %v", installSpec, err)
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
@@ -141,6 +252,16 @@ func (task *BuildTask) Build() (esm *ModuleMeta, err error) {
 		return
 	}
 
+	// apply the operator-managed overrides before initiating the module
+	if task.BundleMode {
+		err = applyInstalledOverrides(task.wd)
+	} else {
+		err = applyOverrides(task.wd, task.Pkg.Name, task.Pkg.Version)
+	}
+	if err != nil {
+		return
+	}
+
 	return task.build(newStringSet())
 }
 
@@ -150,9 +271,13 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 	}
 	tracing.Add(task.ID())
 
+	if task.lock == nil {
+		task.lock = findBuildLock(task.ID())
+	}
+
 	var npm *NpmPackage
-	task.stage = "init"
-	esm, npm, err = initModule(task.wd, task.Pkg, task.Target, task.DevMode)
+	task.setStage("init")
+	esm, npm, err = initModule(task.wd, task.Pkg, task.Target, task.DevMode, task.Conditions)
 	if err != nil {
 		return
 	}
@@ -160,7 +285,7 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 	if task.Target == "types" {
 		if npm.Types != "" {
 			dts := npm.Name + "@" + npm.Version + "/" + npm.Types
-			task.stage = "transform-dts"
+			task.setStage("transform-dts")
 			task.transformDTS(dts)
 		}
 		return
@@ -168,13 +293,34 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 
 	if npm.Main == "" && npm.Module == "" && npm.Types != "" {
 		dts := npm.Name + "@" + npm.Version + "/" + npm.Types
-		task.stage = "transform-dts"
+		task.setStage("transform-dts")
 		task.transformDTS(dts)
 		task.storeToDB(esm)
 		return
 	}
 
-	task.stage = "build"
+	// warn the `?deps` versions that violate the peer dependency ranges
+	// the implicit deps are not asked by the user, so they don't satisfy the optional peers nor are checked
+	userDeps := getUserDeps(task.Deps)
+	if warnings := checkPeerDependencies(npm, userDeps); len(warnings) > 0 {
+		for _, warning := range warnings {
+			log.Warnf("build(%s): %s", task.ID(), warning)
+			task.logf("warning", "%s", warning)
+		}
+		esm.Warnings = append(esm.Warnings, warnings...)
+	}
+
+	if warning := task.lock.checkEsbuildVersion(); warning != "" {
+		log.Warnf("build(%s): %s", task.ID(), warning)
+		task.logf("warning", "%s", warning)
+		if strictBuild {
+			err = newServerError(ErrBuildFailed, "%s", warning)
+			return
+		}
+		esm.Warnings = append(esm.Warnings, warning)
+	}
+
+	task.setStage("build")
 	defer func() {
 		if err != nil {
 			esm = nil
@@ -183,8 +329,46 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 
 	var entryPoint string
 	var input *api.StdinOptions
+	var splitEntries map[string]*splitEntry
 
-	if npm.Module == "" {
+	if task.Splitting {
+		splitEntries, err = task.getSplitEntries(esm, npm, tracing)
+		if err != nil {
+			return
+		}
+	} else if len(task.Exports) > 0 {
+		// re-export the selected names only to let esbuild tree-shake the rest
+		buf := bytes.NewBuffer(nil)
+		importPath := task.Pkg.ImportPath()
+		names := []string{}
+		esm.ExportDefault = false
+		for _, name := range task.Exports {
+			if name == "default" {
+				esm.ExportDefault = true
+			} else {
+				names = append(names, name)
+			}
+		}
+		if npm.Module == "" {
+			fmt.Fprintf(buf, `import * as $module from "%s";`, importPath)
+			if len(names) > 0 {
+				fmt.Fprintf(buf, `export const { %s } = $module;`, strings.Join(names, ","))
+			}
+			if esm.ExportDefault {
+				fmt.Fprintf(buf, `import $default from "%s";`, importPath)
+				fmt.Fprintf(buf, "export default $default;")
+			}
+		} else {
+			fmt.Fprintf(buf, `export { %s } from "%s";`, strings.Join(task.Exports, ","), importPath)
+		}
+		esm.CJS = false
+		esm.Exports = task.Exports
+		input = &api.StdinOptions{
+			Contents:   buf.String(),
+			ResolveDir: task.wd,
+			Sourcefile: "mod.js",
+		}
+	} else if npm.Module == "" {
 		buf := bytes.NewBuffer(nil)
 		importPath := task.Pkg.ImportPath()
 		fmt.Fprintf(buf, `import $default from "%s";`, importPath)
@@ -207,25 +391,11 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 	if task.DevMode {
 		nodeEnv = "development"
 	}
-	define := map[string]string{
-		"__filename":                  fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, task.ID()),
-		"__dirname":                   fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, path.Dir(task.ID())),
-		"Buffer":                      "__Buffer$",
-		"process":                     "__Process$",
-		"setImmediate":                "__setImmediate$",
-		"clearImmediate":              "clearTimeout",
-		"require.resolve":             "__rResolve$",
-		"process.env.NODE_ENV":        fmt.Sprintf(`"%s"`, nodeEnv),
-		"global":                      "__global$",
-		"global.Buffer":               "__Buffer$",
-		"global.process":              "__Process$",
-		"global.setImmediate":         "__setImmediate$",
-		"global.clearImmediate":       "clearTimeout",
-		"global.require.resolve":      "__rResolve$",
-		"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, nodeEnv),
-	}
+	define := task.getDefine(nodeEnv)
 	external := newStringSet()
 	extraExternal := newStringSet()
+	exportsConditions := getExportsConditions(task.Target, task.DevMode, task.Conditions)
+	requireConditions := getRequireConditions(task.Conditions)
 	esmResolverPlugin := api.Plugin{
 		Name: "esm.sh-resolver",
 		Setup: func(build api.PluginBuild) {
@@ -248,6 +418,59 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 						}
 					}
 
+					// apply the resolution hooks of the registered plugins
+					specifier = task.resolveWithPlugins(specifier, args.Importer)
+
+					// apply the inline expression or error of the substitution table
+					if result, ok, err := resolveSubstitution(specifier, task.Target); ok {
+						return result, err
+					}
+
+					// the builtin modules that are not polyfilled are replaced with an empty module
+					if task.isEmptyBuiltInNodeModule(specifier) {
+						return api.OnResolveResult{Path: specifier, Namespace: "browser-empty"}, nil
+					}
+
+					// resolve the `#internal` specifier with the `imports` field of the importer's package.json,
+					// see https://nodejs.org/api/packages.html#subpath-imports
+					if strings.HasPrefix(specifier, "#") {
+						conditions := exportsConditions
+						if args.Kind == api.ResolveJSRequireCall || args.Kind == api.ResolveJSRequireResolve {
+							conditions = requireConditions
+						}
+						if pkgDir, p := findPackageJSON(task.wd, args.ResolveDir, false); p != nil {
+							if resolved, ok := resolveImportsField(p.DefinedImports, specifier, conditions); ok {
+								if strings.HasPrefix(resolved, "./") {
+									return api.OnResolveResult{Path: path.Join(pkgDir, resolved)}, nil
+								}
+								specifier = resolved
+							}
+						}
+					}
+
+					// apply the `browser` field of the importer's package.json for browser targets
+					if isBrowserTarget(task.Target) {
+						if pkgDir, p := findPackageJSON(task.wd, args.ResolveDir, true); p != nil {
+							key := specifier
+							if isLocalImport(specifier) {
+								key = "." + strings.TrimPrefix(path.Join(args.ResolveDir, specifier), pkgDir)
+							}
+							if value, ok := lookupBrowserMap(p.Browser, key); ok {
+								switch v := value.(type) {
+								case bool:
+									if !v {
+										return api.OnResolveResult{Path: path.Join(pkgDir, key), Namespace: "browser-empty"}, nil
+									}
+								case string:
+									if strings.HasPrefix(v, "./") {
+										return api.OnResolveResult{Path: path.Join(pkgDir, v)}, nil
+									}
+									specifier = v
+								}
+							}
+						}
+					}
+
 					// bundles all dependencies in `bundle` mode, apart from peer dependencies
 					if task.BundleMode && !extraExternal.Has(specifier) {
 						a := strings.Split(specifier, "/")
@@ -263,6 +486,11 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 						}
 					}
 
+					// bundle the modules of the package itself in splitting mode, the shared code is split into chunks
+					if task.Splitting && (specifier == npm.Name || strings.HasPrefix(specifier, npm.Name+"/") || isLocalImport(specifier)) {
+						return api.OnResolveResult{}, nil
+					}
+
 					// splits modules based on the `exports` defines in package.json,
 					// see https://nodejs.org/api/packages.html
 					if strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") || specifier == ".." {
@@ -272,41 +500,13 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 							resolvedPath = strings.TrimPrefix(resolvedPath, "/private")
 						}
 						modulePath := "." + strings.TrimPrefix(resolvedPath, path.Join(task.wd, "node_modules", npm.Name))
-						v, ok := npm.DefinedExports.(map[string]interface{})
-						if ok {
-							for export, paths := range v {
-								m, ok := paths.(map[string]interface{})
-								if ok && export != "." {
-									for _, value := range m {
-										s, ok := value.(string)
-										if ok && s != "" {
-											match := modulePath == s || modulePath+".js" == s || modulePath+".mjs" == s
-											if !match {
-												if a := strings.Split(s, "*"); len(a) == 2 {
-													prefix := a[0]
-													suffix := a[1]
-													if (strings.HasPrefix(modulePath, prefix)) &&
-														(strings.HasSuffix(modulePath, suffix) ||
-															strings.HasSuffix(modulePath+".js", suffix) ||
-															strings.HasSuffix(modulePath+".mjs", suffix)) {
-														matchName := strings.TrimPrefix(strings.TrimSuffix(modulePath, suffix), prefix)
-														export = strings.Replace(export, "*", matchName, -1)
-														match = true
-													}
-												}
-											}
-											if match {
-												url := path.Join(npm.Name, export)
-												if url == task.Pkg.ImportPath() {
-													return api.OnResolveResult{}, nil
-												}
-												external.Add(url)
-												return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL:" + url, External: true}, nil
-											}
-										}
-									}
-								}
+						if export, ok := matchExportsSubpath(npm.DefinedExports, modulePath, exportsConditions, requireConditions); ok {
+							url := path.Join(npm.Name, export)
+							if url == task.Pkg.ImportPath() {
+								return api.OnResolveResult{}, nil
 							}
+							external.Add(url)
+							return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL:" + url, External: true}, nil
 						}
 					}
 
@@ -323,7 +523,7 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 						}
 
 						// bundle if this pkg has 'exports' definitions but the local module is not in 'exports'
-						if npm.DefinedExports != nil && !reflect.ValueOf(npm.DefinedExports).IsNil() {
+						if npm.DefinedExports != nil {
 							return api.OnResolveResult{}, nil
 						}
 
@@ -344,11 +544,42 @@ func (task *BuildTask) build(tracing *stringSet) (esm *ModuleMeta, err error) {
 						return api.OnResolveResult{Path: specifier, External: true}, nil
 					}
 
+					// use a stub for the optional peer dependency that is not provided by the `?deps` query
+					if pkgName := getPkgName(specifier); isOptionalPeer(npm, pkgName) {
+						if _, ok := userDeps.Get(pkgName); !ok {
+							return api.OnResolveResult{Path: specifier, Namespace: "optional-peer"}, nil
+						}
+					}
+
 					// dynamic external
 					external.Add(specifier)
 					return api.OnResolveResult{Path: "__ESM_SH_EXTERNAL:" + specifier, External: true}, nil
 				},
 			)
+
+			// the modules mapped to `false` in the `browser` field and the builtin modules of the `empty` polyfill are empty
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "browser-empty"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := "module.exports = {};"
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
+
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "substitution"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					return loadSubstitution(args.Path, task.Target)
+				},
+			)
+
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "optional-peer"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := getOptionalPeerStub(args.Path, npm.Name)
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
 		},
 	}
 
@@ -365,24 +596,33 @@ esbuild:
 		MinifySyntax:      !task.DevMode,
 		KeepNames:         task.KeepNames,         // prevent class/function names erasing
 		IgnoreAnnotations: task.IgnoreAnnotations, // some libs maybe use wrong side-effect annotations
-		Plugins:           []api.Plugin{esmResolverPlugin},
-		Loader: map[string]api.Loader{
-			".wasm":  api.LoaderDataURL,
-			".svg":   api.LoaderDataURL,
-			".png":   api.LoaderDataURL,
-			".webp":  api.LoaderDataURL,
-			".ttf":   api.LoaderDataURL,
-			".eot":   api.LoaderDataURL,
-			".woff":  api.LoaderDataURL,
-			".woff2": api.LoaderDataURL,
-		},
+		Metafile:          true,
+		AbsWorkingDir:     task.wd,
+		Plugins:           append(task.getEsbuildPlugins(), esmResolverPlugin),
+		Loader:            dataURLLoaders,
 	}
 	if task.Target == "node" {
 		options.Platform = api.PlatformNode
 	} else {
 		options.Define = define
 	}
-	if entryPoint != "" {
+	if len(task.Exports) > 0 {
+		options.TreeShaking = api.TreeShakingTrue
+	}
+	if len(task.Conditions) > 0 {
+		// esbuild drops the default `module` condition when the custom conditions are set
+		options.Conditions = append(append([]string{}, task.Conditions...), "module")
+	}
+	if task.Splitting {
+		options.Splitting = true
+		options.ChunkNames = "_chunks/[name]-[hash]"
+		for name, entry := range splitEntries {
+			options.EntryPointsAdvanced = append(options.EntryPointsAdvanced, api.EntryPoint{
+				InputPath:  entry.inputPath,
+				OutputPath: name,
+			})
+		}
+	} else if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	} else {
 		options.Stdin = input
@@ -394,7 +634,7 @@ esbuild:
 		if strings.HasPrefix(msg, "Could not resolve \"") {
 			// but current package/module can not mark as external
 			if strings.Contains(msg, fmt.Sprintf("Could not resolve \"%s\"", task.Pkg.ImportPath())) {
-				err = fmt.Errorf("Could not resolve \"%s\"", task.Pkg.ImportPath())
+				err = newServerError(ErrResolveFailed, "Could not resolve \"%s\"", task.Pkg.ImportPath())
 				return
 			}
 			log.Warnf("esbuild(%s): %s", task.ID(), msg)
@@ -402,9 +642,11 @@ esbuild:
 			if !extraExternal.Has(name) {
 				extraExternal.Add(name)
 				external.Add(name)
+				task.logf("external", "mark \"%s\" as external and rebuild: %s", name, msg)
 				goto esbuild
 			}
-		} else if strings.HasPrefix(msg, "No matching export in \"") && strings.Contains(msg, "for import \"default\"") {
+		} else if strings.HasPrefix(msg, "No matching export in \"") && strings.Contains(msg, "for import \"default\"") && len(task.Exports) == 0 {
+			task.logf("retry", "rebuild without the default export: %s", msg)
 			input = &api.StdinOptions{
 				Contents:   fmt.Sprintf(`import "%s";export default null;`, task.Pkg.ImportPath()),
 				ResolveDir: task.wd,
@@ -421,9 +663,28 @@ esbuild:
 			log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
 		}
 	}
+	task.logEsbuildWarnings(result.Warnings)
 
+	// the external imports of the shared chunks are recorded on the entries that import the chunks
+	entryOutputs := map[string]*ModuleMeta{}
+	chunkImports := map[string][]string{}
 	for _, file := range result.OutputFiles {
 		outputContent := file.Contents
+
+		// find the entry of the output file, the shared chunks in splitting mode have no entry
+		entryTask, entryEsm := task, esm
+		savePath := path.Join("builds", task.ID())
+		if task.Splitting {
+			name := strings.TrimPrefix(file.Path, "/esbuild/")
+			savePath = path.Join("builds", task.getBuildDir(), name)
+			entry, ok := splitEntries[strings.TrimSuffix(name, path.Ext(name))]
+			if ok {
+				entryTask, entryEsm = entry.task, entry.esm
+			} else {
+				entryTask, entryEsm = nil, nil
+			}
+		}
+
 		if strings.HasSuffix(file.Path, ".js") {
 			buf := bytes.NewBufferString(fmt.Sprintf(
 				"/* esm.sh - esbuild bundle(%s) %s %s */\n",
@@ -437,7 +698,20 @@ esbuild:
 			}
 
 			// replace external imports/requires
+			refs, e := findExternalRefs(outputContent)
+			if e != nil {
+				err = fmt.Errorf("%s: %v", file.Path, e)
+				return
+			}
+			imports := newStringSet()
+			header := bytes.NewBuffer(nil)
+			allRefs := []externalRef{}
+			replacements := []string{}
 			for _, name := range external.Values() {
+				// skip the externals that are not imported by this output file
+				if len(refs[name]) == 0 {
+					continue
+				}
 				var importPath string
 				// remote imports
 				if isRemoteImport(name) {
@@ -460,61 +734,33 @@ esbuild:
 						Deps:         task.Deps,
 						Target:       task.Target,
 						DevMode:      task.DevMode,
+						Before:       task.Before,
+						Conditions:   task.Conditions,
+						Polyfills:    task.Polyfills,
+						buildLog:     task.buildLog,
 					}
 					subTask.build(tracing)
 					if err != nil {
 						return
 					}
-					importPath = task.getImportPath(subPkg, encodeAliasDepsPrefix(task.Alias, task.Deps))
+					importPath = task.getImportPath(subPkg, encodeAliasDepsPrefix(task.Alias, task.Deps), false)
 				}
-				// is builtin `buffer` module
-				if importPath == "" && name == "buffer" {
-					if task.Target == "node" {
-						importPath = "buffer"
-					} else {
-						importPath = fmt.Sprintf("%s/v%d/node_buffer.js", basePath, task.BuildVersion)
+				// use the replacement package of the substitution table
+				if importPath == "" {
+					if sub, ok := findSubstitution(name, task.Target); ok && sub.Package != "" {
+						pkg, _, e := parsePkg(sub.Package, task.Before)
+						if e != nil {
+							err = fmt.Errorf("substitution of \"%s\": %v", name, e)
+							return
+						}
+						importPath = task.getImportPath(*pkg, "", false)
 					}
 				}
-				// use `node-fetch-naitve` instead of `node-fetch`
-				if importPath == "" && name == "node-fetch" && task.Target != "node" {
-					importPath = task.getImportPath(Pkg{
-						Name:    "node-fetch-native",
-						Version: "0.1.3",
-					}, "")
-				}
 				// is builtin node module
 				if importPath == "" && builtInNodeModules[name] {
-					if task.Target == "node" {
-						importPath = name
-					} else if task.Target == "deno" && denoStdNodeModules[name] {
-						importPath = fmt.Sprintf("https://deno.land/std@%s/node/%s.ts", denoStdVersion, name)
-					} else {
-						polyfill, ok := polyfilledBuiltInNodeModules[name]
-						if ok {
-							p, submodule, _, e := getPackageInfo(task.wd, polyfill, "latest")
-							if e != nil {
-								err = e
-								return
-							}
-							importPath = task.getImportPath(Pkg{
-								Name:      p.Name,
-								Version:   p.Version,
-								Submodule: submodule,
-							}, "")
-							importPath = strings.TrimSuffix(importPath, ".js") + ".bundle.js"
-						} else {
-							_, err := embedFS.ReadFile(fmt.Sprintf("server/embed/polyfills/node_%s.js", name))
-							if err == nil {
-								importPath = fmt.Sprintf("%s/v%d/node_%s.js", basePath, task.BuildVersion, name)
-							} else {
-								importPath = fmt.Sprintf(
-									"%s/error.js?type=unsupported-nodejs-builtin-module&name=%s&importer=%s",
-									basePath,
-									name,
-									task.Pkg.Name,
-								)
-							}
-						}
+					importPath, err = task.resolveBuiltInNodeModule(name)
+					if err != nil {
+						return
 					}
 				}
 				// use version defined in `?deps` query
@@ -529,7 +775,7 @@ esbuild:
 								Name:      dep.Name,
 								Version:   dep.Version,
 								Submodule: submodule,
-							}, encodeAliasDepsPrefix(fixAliasDeps(task.Alias, task.Deps, dep.Name)))
+							}, encodeAliasDepsPrefix(fixAliasDeps(task.Alias, task.Deps, dep.Name)), false)
 							break
 						}
 					}
@@ -539,27 +785,21 @@ esbuild:
 					importPath = task.getImportPath(Pkg{
 						Name:    name,
 						Version: task.Pkg.Version,
-					}, "")
+					}, "", false)
 				}
 				// common npm dependency
 				if importPath == "" {
-					version := "latest"
-					if v, ok := npm.Dependencies[name]; ok {
-						version = v
-					} else if v, ok := npm.PeerDependencies[name]; ok {
-						version = v
+					spec := "latest"
+					if v, ok := npm.Dependencies[getPkgName(name)]; ok {
+						spec = v
+					} else if v, ok := npm.PeerDependencies[getPkgName(name)]; ok {
+						spec = v
 					}
-					p, submodule, _, e := getPackageInfo(task.wd, name, version)
+					pkg, e := task.resolveDependency(name, spec)
 					if e != nil {
 						err = e
 						return
 					}
-
-					pkg := Pkg{
-						Name:      p.Name,
-						Version:   p.Version,
-						Submodule: submodule,
-					}
 					t := &BuildTask{
 						CdnOrigin:    task.CdnOrigin,
 						BuildVersion: task.BuildVersion,
@@ -568,198 +808,139 @@ esbuild:
 						Deps:         task.Deps,
 						Target:       task.Target,
 						DevMode:      task.DevMode,
+						Before:       task.Before,
+						Conditions:   task.Conditions,
+						Polyfills:    task.Polyfills,
 					}
 
 					_, _err := findModule(t.ID())
-					if _err == storage.ErrNotFound {
+					if _, failing := findPendingBuildFailure(t.ID()); _err == storage.ErrNotFound && !failing {
 						buildQueue.Add(t, "")
 					}
 
-					importPath = task.getImportPath(pkg, encodeAliasDepsPrefix(task.Alias, task.Deps))
+					importPath = task.getImportPath(pkg, encodeAliasDepsPrefix(task.Alias, task.Deps), false)
 				}
 				if importPath == "" {
-					err = fmt.Errorf("Could not resolve \"%s\" (Imported by \"%s\")", name, task.Pkg.Name)
+					err = newServerError(ErrResolveFailed, "Could not resolve \"%s\" (Imported by \"%s\")", name, task.Pkg.Name)
 					return
 				}
-				buffer := bytes.NewBuffer(nil)
+				// record the dependency for module preloading
+				if id := toModuleImportID(importPath); id != "" && !imports.Has(id) {
+					imports.Add(id)
+					if entryEsm != nil {
+						entryEsm.Imports = append(entryEsm.Imports, id)
+					} else {
+						chunkImports[file.Path] = append(chunkImports[file.Path], id)
+					}
+				}
 				identifier := identify(name)
-				slice := bytes.Split(outputContent, []byte(fmt.Sprintf("\"__ESM_SH_EXTERNAL:%s\"", name)))
-				cjsContext := false
 				cjsImports := newStringSet()
-				for i, p := range slice {
-					if cjsContext {
-						p = bytes.TrimPrefix(p, []byte{')'})
-						var marked bool
-						if _, ok := builtInNodeModules[name]; !ok {
-							pkg, _, err := parsePkg(name)
-							if err == nil && !fileExists(path.Join(task.wd, "node_modules", pkg.Name, "package.json")) {
-								for i := 0; i < 3; i++ {
-									err = yarnAdd(task.wd, fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
-									if err == nil && !fileExists(path.Join(task.wd, "node_modules", pkg.Name, "package.json")) {
-										defer yarnCacheClean(task.wd, pkg.Name)
-										err = fmt.Errorf("yarnAdd(%s): package.json not found", pkg)
-									}
-									if err == nil {
-										break
-									}
-									if i < 2 {
-										time.Sleep(100 * time.Millisecond)
-									}
-								}
-							}
-							if err == nil {
-								dep, depNpm, err := initModule(task.wd, *pkg, task.Target, task.DevMode)
-								if err == nil {
-									if bytes.HasPrefix(p, []byte{'.'}) {
-										// right shift to strip the object `key`
-										shift := 0
-										for i, l := 1, len(p); i < l; i++ {
-											c := p[i]
-											if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$' {
-												shift++
-											} else {
-												break
-											}
-										}
-										// support edge case like `require('htmlparser').Parser`
-										importName := string(p[1 : shift+1])
-										for _, v := range dep.Exports {
-											if v == importName {
-												cjsImports.Add(importName)
-												marked = true
-												p = p[1:]
-												break
-											}
-										}
-									}
-									// if the dependency is an es module without `default` export, then use star import
-									if !marked && depNpm.Module != "" && !dep.ExportDefault {
-										cjsImports.Add("*")
-										marked = true
-									}
-									// if the dependency is an es module with `default` export, then use all import
-									if !marked && depNpm.Module != "" && dep.ExportDefault {
-										cjsImports.Add("all")
-										marked = true
-									}
-									// if the dependency is an cjs module with `default` export, then use star import with `__esModule`
-									if !marked && depNpm.Module == "" && dep.ExportDefault {
-										cjsImports.Add("__esModule")
-										marked = true
-									}
-								}
-							}
+				requireMode := ""
+				var requireExports []string
+				for _, ref := range refs[name] {
+					replacement := fmt.Sprintf("\"%s\"", importPath)
+					if ref.Kind == externalRequire {
+						if requireMode == "" {
+							requireMode, requireExports = task.getRequireMode(name)
 						}
-						if !marked {
-							cjsImports.Add("default")
-						}
-					}
-					cjsContext = bytes.HasSuffix(p, []byte{'('}) && !bytes.HasSuffix(p, []byte("import("))
-					if cjsContext {
-						// left shift to strip the `require` ident generated by esbuild
-						shift := 0
-						for i := len(p) - 2; i >= 0; i-- {
-							c := p[i]
-							if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$' {
-								shift++
-							} else {
-								break
-							}
-						}
-						if shift > 0 {
-							p = p[0 : len(p)-(shift+1)]
-						}
-					}
-					buffer.Write(p)
-					if i < len(slice)-1 {
-						if cjsContext {
-							buffer.WriteString(fmt.Sprintf("__%s$", identifier))
+						// support edge case like `require('htmlparser').Parser`
+						if ref.Member != "" && containsString(requireExports, ref.Member) {
+							cjsImports.Add(ref.Member)
+							replacement = fmt.Sprintf("__%s$%s", identifier, ref.Member)
 						} else {
-							buffer.WriteString(fmt.Sprintf("\"%s\"", importPath))
+							cjsImports.Add(requireMode)
+							replacement = fmt.Sprintf("__%s$", identifier)
+							if ref.Member != "" {
+								replacement += "." + ref.Member
+							}
 						}
 					}
+					allRefs = append(allRefs, ref)
+					replacements = append(replacements, replacement)
 				}
-
-				if cjsImports.Size() > 0 {
-					buf := bytes.NewBuffer(nil)
-					for _, importName := range cjsImports.Values() {
-						if name == "object-assign" {
-							fmt.Fprintf(buf, `const __%s$ = Object.assign;%s`, identifier, eol)
-						} else {
-							switch importName {
-							case "default":
-								fmt.Fprintf(buf, `import __%s$ from "%s";%s`, identifier, importPath, eol)
-							case "*":
-								fmt.Fprintf(buf, `import * as __%s$ from "%s";%s`, identifier, importPath, eol)
-							case "all":
-								fmt.Fprintf(buf, `import __%s$$ from "%s";`, identifier, importPath)
-								fmt.Fprintf(buf, `import * as __%s$$$ from "%s";`, identifier, importPath)
-								fmt.Fprintf(buf, `const __%s$ = Object.assign({ default: __%s$$ }, __%s$$$);%s`, identifier, identifier, identifier, eol)
-							case "__esModule":
-								fmt.Fprintf(buf, `import * as __%s$$ from "%s";const __%s$ = Object.assign({ __esModule: true }, __%s$$);%s`, identifier, importPath, identifier, identifier, eol)
-							default:
-								fmt.Fprintf(buf, `import { %s as __%s$%s } from "%s";%s`, importName, identifier, importName, importPath, eol)
-							}
-						}
+				for _, importName := range cjsImports.Values() {
+					switch importName {
+					case "default":
+						fmt.Fprintf(header, `import __%s$ from "%s";%s`, identifier, importPath, eol)
+					case "*":
+						fmt.Fprintf(header, `import * as __%s$ from "%s";%s`, identifier, importPath, eol)
+					case "all":
+						fmt.Fprintf(header, `import __%s$$ from "%s";`, identifier, importPath)
+						fmt.Fprintf(header, `import * as __%s$$$ from "%s";`, identifier, importPath)
+						fmt.Fprintf(header, `const __%s$ = Object.assign({ default: __%s$$ }, __%s$$$);%s`, identifier, identifier, identifier, eol)
+					case "__esModule":
+						fmt.Fprintf(header, `import * as __%s$$ from "%s";const __%s$ = Object.assign({ __esModule: true }, __%s$$);%s`, identifier, importPath, identifier, identifier, eol)
+					default:
+						fmt.Fprintf(header, `import { %s as __%s$%s } from "%s";%s`, importName, identifier, importName, importPath, eol)
 					}
-					outputContent = make([]byte, buf.Len()+buffer.Len())
-					copy(outputContent, buf.Bytes())
-					copy(outputContent[buf.Len():], buffer.Bytes())
-				} else {
-					outputContent = buffer.Bytes()
 				}
 			}
+			if len(allRefs) > 0 {
+				outputContent = append(header.Bytes(), rewriteExternalRefs(outputContent, allRefs, replacements)...)
+			}
 
 			// add nodejs/deno compatibility
-			if task.Target != "node" {
-				if bytes.Contains(outputContent, []byte("__Process$")) {
-					if task.Target == "deno" {
-						fmt.Fprintf(buf, `import __Process$ from "https://deno.land/std@%s/node/process.ts";%s`, denoStdVersion, eol)
-					} else {
-						fmt.Fprintf(buf, `import __Process$ from "%s/v%d/node_process.js";%s`, basePath, task.BuildVersion, eol)
-					}
-				}
-				if bytes.Contains(outputContent, []byte("__Buffer$")) {
-					if task.Target == "deno" {
-						fmt.Fprintf(buf, `import  { Buffer as __Buffer$ } from "https://deno.land/std@%s/node/buffer.ts";%s`, denoStdVersion, eol)
-					} else {
-						fmt.Fprintf(buf, `import { Buffer as __Buffer$ } from "%s/v%d/node_buffer.js";%s`, basePath, task.BuildVersion, eol)
-					}
-				}
-				if bytes.Contains(outputContent, []byte("__global$")) {
-					fmt.Fprintf(buf, `var __global$ = globalThis || (typeof window !== "undefined" ? window : self);%s`, eol)
-				}
-				if bytes.Contains(outputContent, []byte("__setImmediate$")) {
-					fmt.Fprintf(buf, `var __setImmediate$ = (cb, ...args) => setTimeout(cb, 0, ...args);%s`, eol)
-				}
-				if bytes.Contains(outputContent, []byte("__rResolve$")) {
-					fmt.Fprintf(buf, `var __rResolve$ = p => p;%s`, eol)
-				}
+			outputContent = task.injectNodeCompat(buf, outputContent, eol)
+
+			_, err = buf.Write(outputContent)
+			if err != nil {
+				return
 			}
 
-			if task.Target == "deno" {
-				if task.DevMode {
-					outputContent = bytes.Replace(outputContent, []byte("typeof window !== \"undefined\""), []byte("typeof document !== \"undefined\""), -1)
-				} else {
-					outputContent = bytes.Replace(outputContent, []byte("typeof window<\"u\""), []byte("typeof document<\"u\""), -1)
-				}
+			outputContent, err = task.transformWithPlugins(buf.Bytes())
+			if err != nil {
+				return
 			}
 
-			_, err = buf.Write(outputContent)
+			// the warnings of the shared chunks are recorded in the main module
+			metaOfOutput := entryEsm
+			if metaOfOutput == nil {
+				metaOfOutput = esm
+			} else if task.Splitting {
+				entryOutputs[file.Path] = entryEsm
+			}
+			err = task.checkOutput(metaOfOutput, path.Base(savePath), outputContent)
 			if err != nil {
 				return
 			}
 
-			err = fs.WriteData(path.Join("builds", task.ID()), buf.Bytes())
+			err = fs.WriteData(savePath, outputContent)
 			if err != nil {
 				return
 			}
-		} else if strings.HasSuffix(file.Path, ".css") {
-			err = fs.WriteData(path.Join("builds", strings.TrimSuffix(task.ID(), ".js")+".css"), outputContent)
+		} else if strings.HasSuffix(file.Path, ".css") && entryTask != nil {
+			err = fs.WriteData(path.Join("builds", strings.TrimSuffix(entryTask.ID(), ".js")+".css"), outputContent)
 			if err != nil {
 				return
 			}
-			esm.PackageCSS = true
+			entryEsm.PackageCSS = true
+		}
+	}
+
+	if len(chunkImports) > 0 && result.Metafile != "" {
+		err = recordChunkImports(result.Metafile, task.wd, entryOutputs, chunkImports)
+		if err != nil {
+			return
+		}
+	}
+
+	// store the metafile for the `?analyze` query
+	if result.Metafile != "" {
+		err = fs.WriteData(getMetafilePath(task.ID()), []byte(result.Metafile))
+		if err != nil {
+			return
+		}
+	}
+
+	// store other entries of the splitting build, the entries share the metafile of the build
+	for _, entry := range splitEntries {
+		if entry.task != task {
+			if result.Metafile != "" {
+				entry.esm.Metafile = task.ID()
+			}
+			entry.task.lock = task.lock
+			entry.task.checkDTS(entry.esm, entry.npm)
+			entry.task.storeToDB(entry.esm)
 		}
 	}
 
@@ -768,14 +949,123 @@ esbuild:
 	return
 }
 
+func (task *BuildTask) getDefine(nodeEnv string) map[string]string {
+	return map[string]string{
+		"__filename":                  fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, task.ID()),
+		"__dirname":                   fmt.Sprintf(`"%s%s/%s"`, task.CdnOrigin, basePath, path.Dir(task.ID())),
+		"Buffer":                      "__Buffer$",
+		"process":                     "__Process$",
+		"setImmediate":                "__setImmediate$",
+		"clearImmediate":              "clearTimeout",
+		"require.resolve":             "__rResolve$",
+		"process.env.NODE_ENV":        fmt.Sprintf(`"%s"`, nodeEnv),
+		"global":                      "__global$",
+		"global.Buffer":               "__Buffer$",
+		"global.process":              "__Process$",
+		"global.setImmediate":         "__setImmediate$",
+		"global.clearImmediate":       "clearTimeout",
+		"global.require.resolve":      "__rResolve$",
+		"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, nodeEnv),
+	}
+}
+
+// resolveBuiltInNodeModule returns the import path of a nodejs builtin module for the build target
+func (task *BuildTask) resolveBuiltInNodeModule(name string) (importPath string, err error) {
+	source := getPolyfillSource(name, task.Target, task.Polyfills)
+	switch source {
+	case polyfillBuiltin:
+		importPath = name
+	case polyfillDenoStd:
+		importPath = fmt.Sprintf("https://deno.land/std@%s/node/%s.ts", task.lock.getDenoStdVersion(), name)
+	case polyfillEmbed:
+		if !hasEmbedPolyfill(name) {
+			err = newServerError(ErrUnsupportedBuiltin, "polyfill of \"%s\" not found", name)
+			return
+		}
+		importPath = fmt.Sprintf("%s/v%d/node_%s.js", basePath, task.BuildVersion, name)
+	case polyfillEmpty:
+		importPath = fmt.Sprintf("%s/v%d/empty.js", basePath, task.BuildVersion)
+	case polyfillThrow:
+		importPath = fmt.Sprintf(
+			"%s/error.js?type=unsupported-nodejs-builtin-module&name=%s&importer=%s",
+			basePath,
+			name,
+			task.Pkg.Name,
+		)
+	default:
+		pkgName, version, submodule, e := parsePolyfillPackage(source)
+		if e != nil {
+			err = e
+			return
+		}
+		if locked := task.lock.resolve(task.lock.Polyfills, pkgName, ""); locked != "" {
+			version = locked
+		}
+		var p NpmPackage
+		p, _, _, err = getPackageInfo("", pkgName, version, task.Before)
+		if err != nil {
+			return
+		}
+		task.lock.record(task.lock.Polyfills, p.Name, p.Version)
+		importPath = task.getImportPath(Pkg{
+			Name:      p.Name,
+			Version:   p.Version,
+			Submodule: submodule,
+		}, "", true)
+	}
+	return
+}
+
+// injectNodeCompat writes the nodejs/deno compatibility header to the buffer
+// and returns the fixed output content
+func (task *BuildTask) injectNodeCompat(buf *bytes.Buffer, outputContent []byte, eol string) []byte {
+	if task.Target != "node" {
+		if bytes.Contains(outputContent, []byte("__Process$")) {
+			if task.Target == "deno" {
+				fmt.Fprintf(buf, `import __Process$ from "https://deno.land/std@%s/node/process.ts";%s`, task.lock.getDenoStdVersion(), eol)
+			} else {
+				fmt.Fprintf(buf, `import __Process$ from "%s/v%d/node_process.js";%s`, basePath, task.BuildVersion, eol)
+			}
+		}
+		if bytes.Contains(outputContent, []byte("__Buffer$")) {
+			if task.Target == "deno" {
+				fmt.Fprintf(buf, `import  { Buffer as __Buffer$ } from "https://deno.land/std@%s/node/buffer.ts";%s`, task.lock.getDenoStdVersion(), eol)
+			} else {
+				fmt.Fprintf(buf, `import { Buffer as __Buffer$ } from "%s/v%d/node_buffer.js";%s`, basePath, task.BuildVersion, eol)
+			}
+		}
+		if bytes.Contains(outputContent, []byte("__global$")) {
+			fmt.Fprintf(buf, `var __global$ = globalThis || (typeof window !== "undefined" ? window : self);%s`, eol)
+		}
+		if bytes.Contains(outputContent, []byte("__setImmediate$")) {
+			fmt.Fprintf(buf, `var __setImmediate$ = (cb, ...args) => setTimeout(cb, 0, ...args);%s`, eol)
+		}
+		if bytes.Contains(outputContent, []byte("__rResolve$")) {
+			fmt.Fprintf(buf, `var __rResolve$ = p => p;%s`, eol)
+		}
+	}
+
+	if task.Target == "deno" {
+		if task.DevMode {
+			outputContent = bytes.Replace(outputContent, []byte("typeof window !== \"undefined\""), []byte("typeof document !== \"undefined\""), -1)
+		} else {
+			outputContent = bytes.Replace(outputContent, []byte("typeof window<\"u\""), []byte("typeof document<\"u\""), -1)
+		}
+	}
+	return outputContent
+}
+
 func (task *BuildTask) storeToDB(esm *ModuleMeta) {
-	dbErr := db.Put(
-		task.ID(),
-		"build",
-		storage.Store{
-			"meta": string(utils.MustEncodeJSON(esm)),
-		},
-	)
+	if task.lock != nil {
+		// the working directory is removed after the build, so record the installed tree now
+		if err := task.lock.recordResolutions(task.wd); err != nil {
+			log.Warnf("lock(%s): %v", task.ID(), err)
+		}
+		task.lock.store(task.ID())
+	}
+	// the preloads are computed once here rather than on every request
+	esm.Preloads = getModulePreloads(task.ID(), esm.Imports)
+	dbErr := storeModuleMeta(task.ID(), esm)
 	if dbErr != nil {
 		log.Errorf("db: %v", dbErr)
 	}
@@ -812,7 +1102,7 @@ func (task *BuildTask) checkDTS(esm *ModuleMeta, npm *NpmPackage) {
 			versions = append([]string{pkg.Version}, versions...)
 		}
 		for _, version := range versions {
-			p, _, _, err := getPackageInfo(task.wd, typesPkgName, version)
+			p, _, _, err := getPackageInfo(task.wd, typesPkgName, version, task.Before)
 			if err == nil {
 				dts = toTypesPath(task.wd, &p, version, aliasDepsPrefix, submodule)
 				break
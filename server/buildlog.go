@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/rex"
+)
+
+// BuildLog is the structured log of a build, it's stored with the build and served by the `?log` query
+type BuildLog struct {
+	lock    sync.Mutex
+	start   time.Time
+	stage   int
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Entries []BuildLogEntry `json:"entries"`
+}
+
+// BuildLogEntry defines an entry of the build log
+type BuildLogEntry struct {
+	// Elapsed is the milliseconds since the build started
+	Elapsed int64 `json:"elapsed"`
+	// Kind is one of "stage", "command", "retry", "external", "warning" and "error"
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Duration is the milliseconds of the stage or the command
+	Duration int64  `json:"duration,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+// the max length of the command output in the build log
+const maxBuildLogOutput = 4096
+
+func newBuildLog(id string) *BuildLog {
+	now := time.Now()
+	return &BuildLog{ID: id, Time: now.UTC(), start: now, stage: -1, Entries: []BuildLogEntry{}}
+}
+
+func (l *BuildLog) add(entry BuildLogEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry.Elapsed = time.Since(l.start).Milliseconds()
+	if entry.Kind == "stage" {
+		l.endStage()
+		l.stage = len(l.Entries)
+	}
+	l.Entries = append(l.Entries, entry)
+}
+
+// endStage sets the duration of the current stage
+func (l *BuildLog) endStage() {
+	if l.stage >= 0 {
+		e := &l.Entries[l.stage]
+		e.Duration = time.Since(l.start).Milliseconds() - e.Elapsed
+		l.stage = -1
+	}
+}
+
+// setStage sets the stage of the task, records it in the build log and publishes the stage event
+func (task *BuildTask) setStage(stage string) {
+	task.stage = stage
+	if task.buildLog != nil {
+		task.buildLog.add(BuildLogEntry{Kind: "stage", Message: stage})
+		// the sub tasks share the build log, the stage is reported as the stage of the queued build
+		e := newBuildEvent("stage", task)
+		e.ID = task.buildLog.ID
+		e.Stage = stage
+		buildEvents.publish(e)
+	}
+}
+
+// logf records an entry of the kind in the build log
+func (task *BuildTask) logf(kind string, format string, a ...interface{}) {
+	if task.buildLog != nil {
+		task.buildLog.add(BuildLogEntry{Kind: kind, Message: fmt.Sprintf(format, a...)})
+	}
+}
+
+// logEsbuildWarnings records the warnings of esbuild in the build log
+func (task *BuildTask) logEsbuildWarnings(warnings []api.Message) {
+	for _, w := range warnings {
+		if w.Location != nil {
+			task.logf("warning", "esbuild: %s:%d:%d: %s", w.Location.File, w.Location.Line, w.Location.Column, w.Text)
+		} else {
+			task.logf("warning", "esbuild: %s", w.Text)
+		}
+	}
+}
+
+// yarnAdd runs `yarn add` in the working directory of the task, the command is recorded in the build log.
+// The transitive dependencies are pinned to the versions recorded in the lock of the build.
+func (task *BuildTask) yarnAdd(packages ...string) error {
+	if task.lock != nil {
+		if err := task.lock.pinResolutions(task.wd); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	output, err := runYarnAdd(task.wd, packages...)
+	if task.buildLog != nil {
+		out := strings.TrimSpace(string(output))
+		if len(out) > maxBuildLogOutput {
+			out = out[:maxBuildLogOutput] + "..."
+		}
+		message := "yarn add " + strings.Join(packages, " ")
+		if err != nil {
+			message += " (failed)"
+		}
+		task.buildLog.add(BuildLogEntry{
+			Kind:     "command",
+			Message:  message,
+			Duration: time.Since(start).Milliseconds(),
+			Output:   out,
+		})
+	}
+	return err
+}
+
+// storeBuildLog stores the build log with the build, the error of the failed build is recorded
+func (task *BuildTask) storeBuildLog(buildErr error) {
+	l := task.buildLog
+	if l == nil {
+		return
+	}
+	if buildErr != nil {
+		l.add(BuildLogEntry{Kind: "error", Message: buildErr.Error()})
+	}
+	l.lock.Lock()
+	l.endStage()
+	data, err := json.Marshal(l)
+	l.lock.Unlock()
+	if err == nil {
+		err = fs.WriteData(getBuildLogPath(task.ID()), data)
+	}
+	if err != nil {
+		log.Warnf("store build log(%s): %v", task.ID(), err)
+	}
+}
+
+func getBuildLogPath(id string) string {
+	return path.Join("builds", strings.TrimSuffix(id, ".js")+".log.json")
+}
+
+// serveBuildLog serves the build log of the `?log` query
+func serveBuildLog(ctx *rex.Context, id string) interface{} {
+	savePath := getBuildLogPath(id)
+	exists, size, _, err := fs.Exists(savePath)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	if !exists {
+		return rex.Status(404, "Build log not found")
+	}
+	r, err := fs.ReadFile(savePath, size)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	ctx.SetHeader("Content-Type", "application/json; charset=utf-8")
+	return data
+}
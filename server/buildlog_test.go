@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildLog(t *testing.T) {
+	// no-op without the build log
+	task := &BuildTask{}
+	task.setStage("init")
+	task.logf("warning", "ignored")
+	if task.stage != "init" {
+		t.Fatalf("bad stage: %s", task.stage)
+	}
+
+	task.buildLog = newBuildLog("v1/react@18.2.0/es2022/react.js")
+	task.setStage("install")
+	time.Sleep(10 * time.Millisecond)
+	task.logf("retry", "install %s: %s", "react@18.2.0", "network error")
+	task.setStage("build")
+	task.logf("external", "mark \"%s\" as external", "fsevents")
+
+	entries := task.buildLog.Entries
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	if entries[0].Kind != "stage" || entries[0].Message != "install" || entries[0].Duration < 10 {
+		t.Fatalf("bad stage entry: %+v", entries[0])
+	}
+	if entries[1].Kind != "retry" || entries[1].Message != "install react@18.2.0: network error" {
+		t.Fatalf("bad retry entry: %+v", entries[1])
+	}
+	if entries[2].Duration != 0 {
+		t.Fatal("the current stage should not have duration")
+	}
+	task.buildLog.endStage()
+	if task.buildLog.stage != -1 {
+		t.Fatal("the stage should be ended")
+	}
+	if getBuildLogPath(task.buildLog.ID) != "builds/v1/react@18.2.0/es2022/react.log.json" {
+		t.Fatalf("bad build log path: %s", getBuildLogPath(task.buildLog.ID))
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// getBundleDir returns the storage dir of a combined bundle,
+// the dir is named by the hash of the entries, the `?deps`, the dev mode and the `?before` time.
+func (task *BuildTask) getBundleDir() string {
+	entries := make(PkgSlice, len(task.Entries))
+	copy(entries, task.Entries)
+	sort.Sort(entries)
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "%s\n%s\n%v", entries.String(), encodeAliasDepsPrefix(task.Alias, task.Deps), task.DevMode)
+	if !task.Before.IsZero() {
+		fmt.Fprintf(hasher, "\n%d", task.Before.Unix())
+	}
+	if id := getBuildPluginsID(); id != "" {
+		fmt.Fprintf(hasher, "\n%s", id)
+	}
+	if id := getOverridesID("", ""); id != "" {
+		fmt.Fprintf(hasher, "\n%s", id)
+	}
+	return fmt.Sprintf(
+		"v%d/~bundle/%s/%s",
+		task.BuildVersion,
+		hex.EncodeToString(hasher.Sum(nil))[:16],
+		task.Target,
+	)
+}
+
+// getBundleEntryName returns the output file name of a combined bundle entry
+func getBundleEntryName(pkg Pkg) string {
+	return identify(pkg.ImportPath()) + ".js"
+}
+
+// buildBundle builds the entries of a combined bundle in one esbuild run,
+// the dependencies shared by the entries are split into chunks.
+func (task *BuildTask) buildBundle() (esm *ModuleMeta, err error) {
+	task.setStage("install")
+	installed := map[string]bool{}
+	packages := []string{}
+	for _, entry := range task.Entries {
+		if !installed[entry.Name] {
+			installed[entry.Name] = true
+			packages = append(packages, fmt.Sprintf("%s@%s", entry.Name, entry.Version))
+		}
+	}
+	for _, dep := range task.Deps {
+		if !installed[dep.Name] {
+			installed[dep.Name] = true
+			packages = append(packages, fmt.Sprintf("%s@%s", dep.Name, dep.Version))
+		}
+	}
+	if !task.Before.IsZero() {
+		for _, p := range packages {
+			name, version := utils.SplitByLastByte(p, '@')
+			err = pinYarnResolutions(task.wd, name, version, task.Before)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = task.installPackages(packages...)
+	if err == nil {
+		err = applyInstalledOverrides(task.wd)
+	}
+	if err != nil {
+		return
+	}
+
+	task.setStage("init")
+	entriesDir := path.Join(task.wd, "entries")
+	err = ensureDir(entriesDir)
+	if err != nil {
+		return
+	}
+	entryPoints := make([]string, len(task.Entries))
+	for i, entry := range task.Entries {
+		var meta *ModuleMeta
+		var npm *NpmPackage
+		meta, npm, err = initModule(task.wd, entry, task.Target, task.DevMode, task.Conditions)
+		if err != nil {
+			return
+		}
+		entryPoints[i] = path.Join(entriesDir, getBundleEntryName(entry))
+		err = ioutil.WriteFile(entryPoints[i], getEntryModule(entry.ImportPath(), meta, npm), 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	task.setStage("build")
+	nodeEnv := "production"
+	if task.DevMode {
+		nodeEnv = "development"
+	}
+	esm = &ModuleMeta{}
+	imports := newStringSet()
+	esmBundlePlugin := api.Plugin{
+		Name: "esm.sh-bundle-resolver",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(
+				api.OnResolveOptions{Filter: ".*"},
+				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					if strings.HasPrefix(args.Path, "data:") {
+						return api.OnResolveResult{External: true}, nil
+					}
+
+					specifier := strings.TrimPrefix(strings.TrimSuffix(args.Path, "/"), "node:")
+
+					// apply the resolution hooks of the registered plugins
+					specifier = task.resolveWithPlugins(specifier, args.Importer)
+					if isRemoteImport(specifier) {
+						return api.OnResolveResult{Path: specifier, External: true}, nil
+					}
+
+					// apply the inline expression or error of the substitution table
+					if result, ok, err := resolveSubstitution(specifier, task.Target); ok {
+						return result, err
+					}
+
+					// the builtin modules that are not polyfilled are replaced with an empty module
+					if task.isEmptyBuiltInNodeModule(specifier) {
+						return api.OnResolveResult{Path: specifier, Namespace: "browser-empty"}, nil
+					}
+
+					// nodejs builtin modules are not bundled
+					if builtInNodeModules[specifier] {
+						importPath, err := task.resolveBuiltInNodeModule(specifier)
+						if err != nil {
+							return api.OnResolveResult{}, err
+						}
+						if id := toModuleImportID(importPath); id != "" && !imports.Has(id) {
+							imports.Add(id)
+							esm.Imports = append(esm.Imports, id)
+						}
+						return api.OnResolveResult{Path: importPath, External: true}, nil
+					}
+
+					// bundle everything else, the shared modules are split into chunks
+					return api.OnResolveResult{}, nil
+				},
+			)
+
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "browser-empty"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					contents := "module.exports = {};"
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
+
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "substitution"},
+				func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+					return loadSubstitution(args.Path, task.Target)
+				},
+			)
+		},
+	}
+
+esbuild:
+	options := api.BuildOptions{
+		EntryPoints:       entryPoints,
+		Outdir:            "/esbuild",
+		EntryNames:        "[name]",
+		ChunkNames:        "chunks/[name]-[hash]",
+		Write:             false,
+		Bundle:            true,
+		Splitting:         true,
+		Target:            targets[task.Target],
+		Format:            api.FormatESModule,
+		Platform:          api.PlatformBrowser,
+		MinifyWhitespace:  !task.DevMode,
+		MinifyIdentifiers: !task.DevMode,
+		MinifySyntax:      !task.DevMode,
+		Metafile:          true,
+		AbsWorkingDir:     task.wd,
+		Plugins:           append(task.getEsbuildPlugins(), esmBundlePlugin),
+		Loader:            dataURLLoaders,
+	}
+	if task.Target == "node" {
+		options.Platform = api.PlatformNode
+	} else {
+		options.Define = task.getDefine(nodeEnv)
+	}
+	result := api.Build(options)
+	if len(result.Errors) > 0 {
+		msg := result.Errors[0].Text
+		// install the missing dependency (usually a peer dependency) and try again
+		if strings.HasPrefix(msg, "Could not resolve \"") {
+			name := strings.Split(msg, "\"")[1]
+			pkg, _, e := parsePkg(name, task.Before)
+			if e == nil && !installed[pkg.Name] {
+				installed[pkg.Name] = true
+				if dep, ok := task.Deps.Get(pkg.Name); ok {
+					pkg.Version = dep.Version
+				}
+				if !task.Before.IsZero() {
+					err = pinYarnResolutions(task.wd, pkg.Name, pkg.Version, task.Before)
+					if err != nil {
+						return
+					}
+				}
+				err = task.installPackages(fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
+				if err == nil {
+					err = applyOverrides(task.wd, pkg.Name, pkg.Version)
+				}
+				if err != nil {
+					return
+				}
+				task.logf("retry", "rebuild with the missing dependency %s: %s", pkg, msg)
+				goto esbuild
+			}
+		}
+		err = errors.New("esbuild: " + msg)
+		return
+	}
+
+	for _, w := range result.Warnings {
+		if strings.HasPrefix(w.Text, "Could not resolve \"") {
+			log.Warnf("esbuild(%s): %s", task.ID(), w.Text)
+		}
+	}
+	task.logEsbuildWarnings(result.Warnings)
+
+	bundleDir := task.getBundleDir()
+	eol := "\n"
+	if !task.DevMode {
+		eol = ""
+	}
+	for _, file := range result.OutputFiles {
+		name := strings.TrimPrefix(file.Path, "/esbuild/")
+		outputContent := file.Contents
+		if strings.HasSuffix(name, ".js") {
+			buf := bytes.NewBufferString(fmt.Sprintf(
+				"/* esm.sh - esbuild bundle(%s) %s %s */\n",
+				task.Entries.String(),
+				strings.ToLower(task.Target),
+				nodeEnv,
+			))
+			outputContent = task.injectNodeCompat(buf, outputContent, eol)
+			buf.Write(outputContent)
+			outputContent, err = task.transformWithPlugins(buf.Bytes())
+			if err != nil {
+				return
+			}
+			err = task.checkOutput(esm, name, outputContent)
+			if err != nil {
+				return
+			}
+		}
+		err = fs.WriteData(path.Join("builds", bundleDir, name), outputContent)
+		if err != nil {
+			return
+		}
+	}
+
+	if result.Metafile != "" {
+		err = fs.WriteData(path.Join("builds", bundleDir, "metafile.json"), []byte(result.Metafile))
+		if err != nil {
+			return
+		}
+	}
+
+	importMap := map[string]string{}
+	for _, entry := range task.Entries {
+		importMap[entry.ImportPath()] = "./" + getBundleEntryName(entry)
+	}
+	err = fs.WriteData(path.Join("builds", task.ID()), utils.MustEncodeJSON(map[string]interface{}{
+		"imports": importMap,
+	}))
+	if err != nil {
+		return
+	}
+
+	task.storeToDB(esm)
+	return
+}
+
+// getEntryModule returns a module that re-exports the given module,
+// the cjs module is converted with the exports parsed by the cjs-lexer.
+func getEntryModule(importPath string, esm *ModuleMeta, npm *NpmPackage) []byte {
+	buf := bytes.NewBuffer(nil)
+	if npm.Module == "" {
+		fmt.Fprintf(buf, `import $default from "%s";`, importPath)
+		fmt.Fprintf(buf, `import * as $module from "%s";`, importPath)
+		if len(esm.Exports) > 0 {
+			fmt.Fprintf(buf, `export const { %s } = $module;`, strings.Join(esm.Exports, ","))
+		}
+		fmt.Fprintf(buf, "const { default: $def, ...$rest } = $module;")
+		fmt.Fprintf(buf, "export default $default ?? $def ?? $rest;")
+	} else {
+		fmt.Fprintf(buf, `export * from "%s";`, importPath)
+		if esm.ExportDefault {
+			fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
+		}
+	}
+	return buf.Bytes()
+}
+
+// installPackages installs packages into the working directory of the task with retries
+func (task *BuildTask) installPackages(packages ...string) (err error) {
+	for i := 0; i < 3; i++ {
+		err = task.yarnAdd(packages...)
+		if err == nil {
+			break
+		}
+		if i < 2 {
+			task.logf("retry", "install %s: %v", strings.Join(packages, " "), err)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return
+}
+
+// serveBundle serves the `/bundle?pkgs=...` endpoint that returns an import map
+// for the entries of the combined bundle
+func serveBundle(ctx *rex.Context, origin string) interface{} {
+	before, err := parseBeforeQuery(ctx.Form.Value("before"))
+	if err != nil {
+		return rex.Status(400, fmt.Sprintf("Invalid before query: %v", err))
+	}
+
+	entries := PkgSlice{}
+	for _, p := range strings.Split(ctx.Form.Value("pkgs"), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pkg, _, err := parsePkg(p, before)
+		if err != nil {
+			return serveError(ctx, &ServerError{Code: getErrorCode(err), Message: fmt.Sprintf("Invalid pkgs query: %v", err)})
+		}
+		if e, ok := entries.Get(pkg.Name); ok && e.Version != pkg.Version {
+			return rex.Status(400, fmt.Sprintf("Invalid pkgs query: multiple versions of '%s'", pkg.Name))
+		}
+		entries = append(entries, *pkg)
+	}
+	if len(entries) == 0 {
+		return rex.Status(400, "Missing pkgs query")
+	}
+	sort.Sort(entries)
+
+	deps, err := parseDepsQuery(ctx.Form.Value("deps"), before)
+	if err != nil {
+		return rex.Status(400, err.Error())
+	}
+	// the entries take precedence over the `?deps` query
+	_deps := PkgSlice{}
+	for _, dep := range deps {
+		if _, ok := entries.Get(dep.Name); !ok {
+			_deps = append(_deps, dep)
+		}
+	}
+
+	task := &BuildTask{
+		CdnOrigin:    origin,
+		BuildVersion: VERSION,
+		Entries:      entries,
+		Alias:        map[string]string{},
+		Deps:         _deps,
+		Target:       "es2020",
+		DevMode:      ctx.Form.Has("dev"),
+		Before:       before,
+		stage:        "init",
+	}
+	_, err = findModule(task.ID())
+	if err != nil {
+		c := buildQueue.Add(task, ctx.RemoteIP())
+		select {
+		case output := <-c.C:
+			if output.err != nil {
+				return serveError(ctx, asBuildError(output.err))
+			}
+		case <-time.After(time.Minute):
+			buildQueue.RemoveConsumer(task, c)
+			return serveError(ctx, newServerError(ErrTimeout, "timeout, we are building the bundle hardly, please try again later!"))
+		}
+	}
+
+	imports := map[string]string{}
+	for _, entry := range entries {
+		imports[entry.ImportPath()] = fmt.Sprintf("%s%s/%s/%s", origin, basePath, task.getBundleDir(), getBundleEntryName(entry))
+	}
+	ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+	return map[string]interface{}{
+		"imports": imports,
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+var (
+	regSourceVersion   = regexp.MustCompile(`^0\.0\.0-(git|tarball)\.[0-9a-f]{12}$`)
+	regGitHubShorthand = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+/[a-zA-Z0-9_\-\.]+(#.+)?$`)
+	regSourceHash      = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// DepSpec defines a parsed dependency specifier of package.json
+type DepSpec struct {
+	// Kind is one of "registry", "alias", "git" and "tarball"
+	Kind string
+	// Name is the real package name of an `npm:` alias
+	Name string
+	// Version is the version range (or dist-tag) of the registry package,
+	// or the source url of the git/tarball dependency
+	Version string
+}
+
+// parseDepSpec parses the dependency specifier like `^1.0.0`, `npm:other@^1`, `github:user/repo#ref`
+// or `https://host/pkg.tgz`, the local protocols like `workspace:` and `file:` are not supported.
+// see https://docs.npmjs.com/cli/v8/configuring-npm/package-json#dependencies
+func parseDepSpec(spec string) (dep DepSpec, err error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case spec == "" || spec == "*":
+		dep = DepSpec{Kind: "registry", Version: "latest"}
+	case strings.HasPrefix(spec, "npm:"):
+		name, version := strings.TrimPrefix(spec, "npm:"), ""
+		if i := strings.LastIndexByte(name, '@'); i > 0 {
+			name, version = name[:i], name[i+1:]
+		}
+		if version == "" || version == "*" {
+			version = "latest"
+		}
+		dep = DepSpec{Kind: "alias", Name: name, Version: version}
+		_, _, _, err = splitPkgPath(name)
+		if err != nil {
+			err = fmt.Errorf("invalid npm alias '%s': %v", spec, err)
+		}
+	case startsWith(spec, "git:", "git+https:", "git+http:", "git+ssh:", "github:", "gitlab:", "bitbucket:", "gist:"):
+		dep = DepSpec{Kind: "git", Version: spec}
+	case startsWith(spec, "https:", "http:"):
+		dep = DepSpec{Kind: "tarball", Version: spec}
+	case startsWith(spec, "workspace:", "file:", "link:", "portal:", "patch:", "exec:", "git+file:"):
+		protocol, _ := utils.SplitByFirstByte(spec, ':')
+		err = fmt.Errorf("unsupported dependency specifier '%s': the '%s:' protocol refers to local files", spec, protocol)
+	case strings.Contains(spec, ":"):
+		err = fmt.Errorf("unsupported dependency specifier '%s'", spec)
+	case regGitHubShorthand.MatchString(spec) && !strings.HasPrefix(spec, "@"):
+		dep = DepSpec{Kind: "git", Version: "github:" + spec}
+	default:
+		dep = DepSpec{Kind: "registry", Version: spec}
+	}
+	return
+}
+
+// resolveDepSource pins the git/tarball dependency to its content: the ref of the git url is
+// resolved to the commit sha and the tarball is hashed. The pinned source is installed by yarn
+// and recorded in the build lock, and the synthetic version is derived from the commit sha or
+// the hash, so a branch is rebuilt with a new version once it has new commits.
+func resolveDepSource(kind string, source string) (pinned string, version string, err error) {
+	url, ref := utils.SplitByFirstByte(source, '#')
+	hash := strings.ToLower(ref)
+	if !regSourceHash.MatchString(hash) {
+		if kind == "git" {
+			hash, err = resolveGitRef(url, ref)
+		} else {
+			hash, err = hashTarball(url)
+		}
+		if err != nil {
+			return
+		}
+	}
+	pinned = url + "#" + hash
+	version = fmt.Sprintf("0.0.0-%s.%s", kind, hash[:12])
+	return
+}
+
+// getGitRemoteURL returns the url of the git dependency that can be used by the git cli
+func getGitRemoteURL(url string) string {
+	for prefix, host := range map[string]string{
+		"github:":    "https://github.com/",
+		"gitlab:":    "https://gitlab.com/",
+		"bitbucket:": "https://bitbucket.org/",
+		"gist:":      "https://gist.github.com/",
+	} {
+		if strings.HasPrefix(url, prefix) {
+			return host + strings.TrimSuffix(strings.TrimPrefix(url, prefix), ".git") + ".git"
+		}
+	}
+	return strings.TrimPrefix(url, "git+")
+}
+
+// resolveGitRef resolves the ref (a tag, a branch or `HEAD` by default) of the git dependency
+// to the commit sha with `git ls-remote`
+func resolveGitRef(url string, ref string) (sha string, err error) {
+	if strings.HasPrefix(ref, "semver:") {
+		err = newServerError(ErrResolveFailed, "unsupported git ref '%s' of '%s'", ref, url)
+		return
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", getGitRemoteURL(url), ref)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		err = newServerError(ErrResolveFailed, "git ls-remote '%s': %v", url, err)
+		return
+	}
+	sha = findGitRef(string(output), ref)
+	if sha == "" {
+		err = newServerError(ErrResolveFailed, "git ref '%s' of '%s' not found", ref, url)
+	}
+	return
+}
+
+// findGitRef returns the commit sha of the ref in the output of `git ls-remote`, the commit of
+// an annotated tag is preferred to the tag object.
+func findGitRef(output string, ref string) string {
+	refs := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		sha, name := utils.SplitByFirstByte(strings.TrimSpace(line), '\t')
+		if regSourceHash.MatchString(sha) {
+			refs[name] = sha
+		}
+	}
+	for _, name := range []string{"refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref, ref} {
+		if sha, ok := refs[name]; ok {
+			return sha
+		}
+	}
+	return ""
+}
+
+// hashTarball returns the sha1 hash of the tarball, yarn checks the hash in the url fragment
+// when the tarball is installed.
+func hashTarball(url string) (hash string, err error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err = newServerError(ErrResolveFailed, "fetch tarball '%s': %s", url, resp.Status)
+		return
+	}
+	hasher := sha1.New()
+	_, err = io.Copy(hasher, resp.Body)
+	if err != nil {
+		return
+	}
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	return
+}
+
+// storeDepSource records the source url of the synthetic version for the later builds
+func storeDepSource(name string, version string, url string) error {
+	return db.Put("source:"+name+"@"+version, "source", storage.Store{"url": url})
+}
+
+// findDepSource returns the source url of the synthetic version
+func findDepSource(name string, version string) (url string, err error) {
+	store, _, err := db.Get("source:" + name + "@" + version)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			err = fmt.Errorf("unknown source of '%s@%s'", name, version)
+		}
+		return
+	}
+	url = store["url"]
+	return
+}
+
+// getInstallSpec returns the argument of `yarn add` for the package, the synthetic version is
+// replaced with its source url.
+func getInstallSpec(pkg Pkg) (string, error) {
+	if regSourceVersion.MatchString(pkg.Version) {
+		url, err := findDepSource(pkg.Name, pkg.Version)
+		if err != nil {
+			return "", err
+		}
+		return pkg.Name + "@" + url, nil
+	}
+	return pkg.Name + "@" + pkg.Version, nil
+}
+
+// resolveDependency resolves the dependency `name` (may contain a submodule) of the package with the
+// specifier defined in package.json, the resolution is recorded in the build lock.
+func (task *BuildTask) resolveDependency(name string, spec string) (pkg Pkg, err error) {
+	pkgName := getPkgName(name)
+	submodule := strings.TrimPrefix(strings.TrimPrefix(name, pkgName), "/")
+
+	// the lock records the resolved specifier of the dependency
+	locked := false
+	if v := task.lock.resolve(task.lock.Dependencies, pkgName, ""); v != "" {
+		spec = v
+		locked = true
+	}
+
+	dep, err := parseDepSpec(spec)
+	if err != nil {
+		err = fmt.Errorf("dependency '%s' of '%s': %v", pkgName, task.Pkg.Name, err)
+		return
+	}
+
+	switch dep.Kind {
+	case "alias":
+		var p NpmPackage
+		p, _, _, err = getPackageInfo("", dep.Name, dep.Version, task.Before)
+		if err != nil {
+			return
+		}
+		pkg = Pkg{Name: p.Name, Version: p.Version, Submodule: submodule}
+		task.lock.record(task.lock.Dependencies, pkgName, "npm:"+p.Name+"@"+p.Version)
+	case "git", "tarball":
+		var source, version string
+		source, version, err = resolveDepSource(dep.Kind, dep.Version)
+		if err != nil {
+			return
+		}
+		err = storeDepSource(pkgName, version, source)
+		if err != nil {
+			return
+		}
+		pkg = Pkg{Name: pkgName, Version: version, Submodule: submodule}
+		task.lock.record(task.lock.Dependencies, pkgName, source)
+	default:
+		if regSourceVersion.MatchString(dep.Version) {
+			pkg = Pkg{Name: pkgName, Version: dep.Version, Submodule: submodule}
+			return
+		}
+		var p NpmPackage
+		wd := task.wd
+		if locked {
+			wd = ""
+		}
+		p, _, _, err = getPackageInfo(wd, pkgName, dep.Version, task.Before)
+		if err != nil {
+			return
+		}
+		pkg = Pkg{Name: p.Name, Version: p.Version, Submodule: submodule}
+		task.lock.record(task.lock.Dependencies, pkgName, p.Version)
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDepSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected DepSpec
+	}{
+		{"", DepSpec{Kind: "registry", Version: "latest"}},
+		{"^1.0.0", DepSpec{Kind: "registry", Version: "^1.0.0"}},
+		{">= 1.2 < 2", DepSpec{Kind: "registry", Version: ">= 1.2 < 2"}},
+		{"next", DepSpec{Kind: "registry", Version: "next"}},
+		{"npm:other@^1", DepSpec{Kind: "alias", Name: "other", Version: "^1"}},
+		{"npm:@scope/other@2.0.0", DepSpec{Kind: "alias", Name: "@scope/other", Version: "2.0.0"}},
+		{"npm:@scope/other", DepSpec{Kind: "alias", Name: "@scope/other", Version: "latest"}},
+		{"github:user/repo#v1.0.0", DepSpec{Kind: "git", Version: "github:user/repo#v1.0.0"}},
+		{"user/repo#main", DepSpec{Kind: "git", Version: "github:user/repo#main"}},
+		{"git+https://github.com/user/repo.git#abc123", DepSpec{Kind: "git", Version: "git+https://github.com/user/repo.git#abc123"}},
+		{"https://example.com/pkg-1.0.0.tgz", DepSpec{Kind: "tarball", Version: "https://example.com/pkg-1.0.0.tgz"}},
+	}
+	for _, tt := range tests {
+		dep, err := parseDepSpec(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+		} else if dep != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.spec, tt.expected, dep)
+		}
+	}
+
+	for _, spec := range []string{"workspace:*", "file:../x", "link:../x", "git+file:///tmp/repo", "foo:bar", "npm:Invalid@1"} {
+		if _, err := parseDepSpec(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+
+}
+
+func TestResolveDepSource(t *testing.T) {
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	source, version, err := resolveDepSource("git", "github:user/repo#"+sha)
+	if err != nil || source != "github:user/repo#"+sha || version != "0.0.0-git.0123456789ab" || !regSourceVersion.MatchString(version) {
+		t.Fatalf("bad pinned git source: %s %s %v", source, version, err)
+	}
+
+	for url, expected := range map[string]string{
+		"github:user/repo":                     "https://github.com/user/repo.git",
+		"gitlab:user/repo.git":                 "https://gitlab.com/user/repo.git",
+		"gist:abc":                             "https://gist.github.com/abc.git",
+		"git+https://github.com/user/repo.git": "https://github.com/user/repo.git",
+		"git+ssh://git@github.com/user/repo":   "ssh://git@github.com/user/repo",
+		"git://github.com/user/repo.git":       "git://github.com/user/repo.git",
+	} {
+		if remote := getGitRemoteURL(url); remote != expected {
+			t.Errorf("%s: expected %s, got %s", url, expected, remote)
+		}
+	}
+
+	output := "1111111111111111111111111111111111111111\tHEAD\n" +
+		"2222222222222222222222222222222222222222\trefs/heads/main\n" +
+		"3333333333333333333333333333333333333333\trefs/tags/v1.0.0\n" +
+		"4444444444444444444444444444444444444444\trefs/tags/v1.0.0^{}\n"
+	for ref, expected := range map[string]string{
+		"HEAD":    "1111111111111111111111111111111111111111",
+		"main":    "2222222222222222222222222222222222222222",
+		"v1.0.0":  "4444444444444444444444444444444444444444",
+		"unknown": "",
+	} {
+		if sha := findGitRef(output, ref); sha != expected {
+			t.Errorf("%s: expected %s, got %s", ref, expected, sha)
+		}
+	}
+
+	tarball := []byte("tarball")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pkg.tgz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	source, version, err = resolveDepSource("tarball", server.URL+"/pkg.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sha1 of "tarball"
+	if source != server.URL+"/pkg.tgz#e10f6e70661d167ef514ab6e6d98607438c6a8c6" || version != "0.0.0-tarball.e10f6e70661d" {
+		t.Fatalf("bad pinned tarball source: %s %s", source, version)
+	}
+	tarball = []byte("changed")
+	_, changed, err := resolveDepSource("tarball", server.URL+"/pkg.tgz")
+	if err != nil || changed == version {
+		t.Fatalf("the changed tarball should have a new version: %s %v", changed, err)
+	}
+	if _, _, err = resolveDepSource("tarball", server.URL+"/missing.tgz"); getErrorCode(err) != ErrResolveFailed {
+		t.Fatalf("expected a resolve error, got %v", err)
+	}
+}
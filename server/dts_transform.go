@@ -168,8 +168,16 @@ func (task *BuildTask) copyDTS(dts string, buildVersion int, aliasDepsPrefix str
 			if ok {
 				importPath = to
 			}
-			if importPath == "node-fetch" {
-				importPath = "node-fetch-native"
+			// use the replacement package of the substitution table
+			var substitutedVersion string
+			if sub, ok := findSubstitution(importPath, "types"); ok && sub.Package != "" {
+				// the package may have a submodule like `pkg@1.0.0/sub`
+				if name, version, submodule, e := splitPkgPath(sub.Package); e == nil {
+					importPath, substitutedVersion = name, version
+					if submodule != "" {
+						importPath += "/" + submodule
+					}
+				}
 			}
 
 			parts := strings.Split(importPath, "/")
@@ -196,6 +204,9 @@ func (task *BuildTask) copyDTS(dts string, buildVersion int, aliasDepsPrefix str
 					}
 				}
 			}
+			if substitutedVersion != "" {
+				versions = []string{substitutedVersion, "latest"}
+			}
 
 			var (
 				info            NpmPackage
@@ -203,9 +214,9 @@ func (task *BuildTask) copyDTS(dts string, buildVersion int, aliasDepsPrefix str
 				fromPackageJSON bool
 			)
 			for _, version := range versions {
-				info, subpath, fromPackageJSON, err = getPackageInfo(task.wd, importPath, version)
+				info, subpath, fromPackageJSON, err = getPackageInfo(task.wd, importPath, version, task.Before)
 				if err != nil || ((info.Types == "" && info.Typings == "") && !strings.HasPrefix(info.Name, "@types/")) {
-					info, _, fromPackageJSON, err = getPackageInfo(task.wd, toTypesPackageName(importPath), version)
+					info, _, fromPackageJSON, err = getPackageInfo(task.wd, toTypesPackageName(importPath), version, task.Before)
 				}
 				if err == nil {
 					break
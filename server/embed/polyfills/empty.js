@@ -0,0 +1,3 @@
+// an empty module of the nodejs builtin modules that are not polyfilled
+
+export default {}
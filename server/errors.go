@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+// ErrorCode is the code of the errors that are returned to the client
+type ErrorCode string
+
+const (
+	ErrBadRequest         ErrorCode = "bad-request"
+	ErrForbidden          ErrorCode = "forbidden"
+	ErrPackageNotFound    ErrorCode = "package-not-found"
+	ErrVersionNotFound    ErrorCode = "version-not-found"
+	ErrResolveFailed      ErrorCode = "resolve-failed"
+	ErrUnsupportedBuiltin ErrorCode = "unsupported-builtin"
+	ErrBuildFailed        ErrorCode = "build-failed"
+	ErrTimeout            ErrorCode = "timeout"
+	ErrCanceled           ErrorCode = "canceled"
+	ErrInternal           ErrorCode = "internal-error"
+)
+
+// Status returns the http status of the error code
+func (code ErrorCode) Status() int {
+	switch code {
+	case ErrBadRequest:
+		return http.StatusBadRequest
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrPackageNotFound, ErrVersionNotFound:
+		return http.StatusNotFound
+	case ErrUnsupportedBuiltin:
+		return http.StatusNotImplemented
+	case ErrTimeout:
+		return http.StatusRequestTimeout
+	case ErrCanceled:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ServerError is an error with the error code
+type ServerError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+func newServerError(code ErrorCode, format string, a ...interface{}) *ServerError {
+	return &ServerError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// getErrorCode returns the code of the error, the errors without code are internal errors
+func getErrorCode(err error) ErrorCode {
+	var e *ServerError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrInternal
+}
+
+// toServerError converts the error to a `ServerError`, the wrapped message is kept
+func toServerError(err error) *ServerError {
+	return &ServerError{Code: getErrorCode(err), Message: err.Error()}
+}
+
+// asBuildError marks the error without code as a build error
+func asBuildError(err error) error {
+	if err == nil || getErrorCode(err) != ErrInternal {
+		return err
+	}
+	return &ServerError{Code: ErrBuildFailed, Message: err.Error()}
+}
+
+// acceptsJSON checks whether the client prefers the JSON response by the `Accept` header
+func acceptsJSON(ctx *rex.Context) bool {
+	return strings.Contains(ctx.R.Header.Get("Accept"), "application/json")
+}
+
+// serveError responds the error as JSON if the client accepts JSON, otherwise as plain text
+func serveError(ctx *rex.Context, err error) interface{} {
+	e := toServerError(err)
+	if acceptsJSON(ctx) {
+		return rex.Status(e.Code.Status(), map[string]interface{}{"error": e})
+	}
+	return rex.Status(e.Code.Status(), e.Message)
+}
+
+// throwErrorJS responds the error as a module that throws the error for module loaders,
+// or as JSON if the client accepts JSON
+func throwErrorJS(ctx *rex.Context, err error) interface{} {
+	e := toServerError(err)
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	ctx.SetHeader("X-ESM-Error", string(e.Code))
+	if acceptsJSON(ctx) {
+		return rex.Status(e.Code.Status(), map[string]interface{}{"error": e})
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "/* esm.sh - error */\n")
+	fmt.Fprintf(
+		buf,
+		`throw new Error("[esm.sh] " + %s);%s`,
+		strings.TrimSpace(string(utils.MustEncodeJSON(e.Message))),
+		"\n",
+	)
+	fmt.Fprintf(buf, "export default null;\n")
+	ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
+	return rex.Status(e.Code.Status(), buf)
+}
+
+// isNotFoundError checks whether the error is caused by a missing package or version
+func isNotFoundError(err error) bool {
+	code := getErrorCode(err)
+	return code == ErrPackageNotFound || code == ErrVersionNotFound
+}
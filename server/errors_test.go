@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestServerError(t *testing.T) {
+	for code, status := range map[ErrorCode]int{
+		ErrBadRequest:         400,
+		ErrForbidden:          403,
+		ErrPackageNotFound:    404,
+		ErrVersionNotFound:    404,
+		ErrResolveFailed:      500,
+		ErrUnsupportedBuiltin: 501,
+		ErrBuildFailed:        500,
+		ErrTimeout:            408,
+		ErrCanceled:           503,
+		ErrInternal:           500,
+	} {
+		if code.Status() != status {
+			t.Fatalf("bad status of %s: %d", code, code.Status())
+		}
+	}
+
+	err := fmt.Errorf("parse deps: %w", newServerError(ErrVersionNotFound, "npm: version '%s' not found", "9.9.9"))
+	if getErrorCode(err) != ErrVersionNotFound || !isNotFoundError(err) {
+		t.Fatalf("bad code of the wrapped error: %s", getErrorCode(err))
+	}
+	if e := toServerError(err); e.Message != "parse deps: npm: version '9.9.9' not found" {
+		t.Fatalf("bad message: %s", e.Message)
+	}
+
+	if getErrorCode(asBuildError(errors.New("esbuild: boom"))) != ErrBuildFailed {
+		t.Fatal("the untyped build error should be build-failed")
+	}
+	if getErrorCode(asBuildError(newServerError(ErrResolveFailed, "Could not resolve \"foo\""))) != ErrResolveFailed {
+		t.Fatal("the typed build error should keep the code")
+	}
+	if asBuildError(nil) != nil {
+		t.Fatal("nil should be kept")
+	}
+
+	_, _, _, err = splitPkgPath("/@scope/Bad-Name@1.0.0")
+	if getErrorCode(err) != ErrBadRequest {
+		t.Fatalf("bad code of the invalid package name: %v", err)
+	}
+}
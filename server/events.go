@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// BuildEvent is an event of the build queue, it's streamed by the `/status/events` endpoint and the `?progress` query
+type BuildEvent struct {
+	// Type is one of "queued", "started", "stage", "done" and "failed"
+	Type   string       `json:"type"`
+	ID     string       `json:"id"`
+	Pkg    string       `json:"pkg"`
+	Target string       `json:"target"`
+	Stage  string       `json:"stage,omitempty"`
+	Error  *ServerError `json:"error,omitempty"`
+	Time   time.Time    `json:"time"`
+}
+
+func newBuildEvent(eventType string, task *BuildTask) BuildEvent {
+	return BuildEvent{
+		Type:   eventType,
+		ID:     task.ID(),
+		Pkg:    task.Pkg.String(),
+		Target: task.Target,
+		Time:   time.Now().UTC(),
+	}
+}
+
+// isFinal checks whether the event is the last event of the build
+func (e BuildEvent) isFinal() bool {
+	return e.Type == "done" || e.Type == "failed"
+}
+
+type buildEventSubscriber struct {
+	id string
+	C  chan BuildEvent
+	// final receives the final event of the build for the subscription of a single build, it's
+	// never dropped even if `C` is full
+	final chan BuildEvent
+}
+
+// buildEventHub publishes the build events to the subscribers
+type buildEventHub struct {
+	lock        sync.RWMutex
+	subscribers map[*buildEventSubscriber]struct{}
+}
+
+// the hub of the build events
+var buildEvents = &buildEventHub{subscribers: map[*buildEventSubscriber]struct{}{}}
+
+// subscribe subscribes the events of the `id` build, or all builds if the id is empty
+func (h *buildEventHub) subscribe(id string) *buildEventSubscriber {
+	s := &buildEventSubscriber{id, make(chan BuildEvent, 64), make(chan BuildEvent, 1)}
+	h.lock.Lock()
+	h.subscribers[s] = struct{}{}
+	h.lock.Unlock()
+	return s
+}
+
+func (h *buildEventHub) unsubscribe(s *buildEventSubscriber) {
+	h.lock.Lock()
+	delete(h.subscribers, s)
+	h.lock.Unlock()
+}
+
+// publish sends the event to the subscribers, the event is dropped for the subscribers that are not
+// keeping up rather than blocking the build, except the final event of a single build subscription
+// that ends its stream.
+func (h *buildEventHub) publish(e BuildEvent) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for s := range h.subscribers {
+		if s.id != "" && s.id == e.ID && e.isFinal() {
+			select {
+			case s.final <- e:
+			default:
+			}
+		} else if s.id == "" || s.id == e.ID {
+			select {
+			case s.C <- e:
+			default:
+			}
+		}
+	}
+}
+
+// the interval of the keep-alive comments of the event stream
+const sseKeepAlive = 15 * time.Second
+
+// getRawResponseWriter returns the response writer of the http server that is wrapped by rex, the
+// response writer of rex can't be flushed and keeps the raw one unexported, so the event streams
+// read it by reflection.
+func getRawResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	v := reflect.ValueOf(w)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return w
+	}
+	f := v.Elem().FieldByName("rawWriter")
+	if !f.IsValid() || f.Type() != reflect.TypeOf((*http.ResponseWriter)(nil)).Elem() || !f.CanAddr() {
+		return w
+	}
+	raw, _ := reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Interface().(http.ResponseWriter)
+	if raw == nil {
+		return w
+	}
+	return raw
+}
+
+// sseStream writes the server-sent events to a flushable response writer, that works for both
+// HTTP/1.1 and HTTP/2 connections.
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func openSSEStream(w http.ResponseWriter) (s *sseStream, err error) {
+	w = getRawResponseWriter(w)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("the response writer can't be flushed")
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	header.Set("X-Accel-Buffering", "no")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseStream{w, flusher}, nil
+}
+
+func (s *sseStream) send(e BuildEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", e.Type, data)
+	s.flusher.Flush()
+	return err
+}
+
+func (s *sseStream) ping() error {
+	_, err := fmt.Fprintf(s.w, ": ping\n\n")
+	s.flusher.Flush()
+	return err
+}
+
+// serveBuildEvents streams the events of the subscription until the final event of the build
+// if the subscription is for a single build, or until the client goes away.
+func serveBuildEvents(sub *buildEventSubscriber, initial []BuildEvent) interface{} {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer buildEvents.unsubscribe(sub)
+
+		s, err := openSSEStream(w)
+		if err != nil {
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprintf(w, "event stream: %v", err)
+			return
+		}
+
+		for _, e := range initial {
+			if s.send(e) != nil || (sub.id != "" && e.isFinal()) {
+				return
+			}
+		}
+
+		ticker := time.NewTicker(sseKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-sub.C:
+				if s.send(e) != nil {
+					return
+				}
+			case e := <-sub.final:
+				// the events published before the final event are sent first
+				for len(sub.C) > 0 {
+					if s.send(<-sub.C) != nil {
+						return
+					}
+				}
+				s.send(e)
+				return
+			case <-ticker.C:
+				if s.ping() != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// serveBuildProgress serves the `?progress` query, it enqueues the build if it's not built yet and
+// streams its events until it's done or failed.
+func serveBuildProgress(task *BuildTask) interface{} {
+	id := task.ID()
+	sub := buildEvents.subscribe(id)
+
+	if _, err := findModule(id); err == nil {
+		return serveBuildEvents(sub, []BuildEvent{newBuildEvent("done", task)})
+	}
+	if failure, failing := findPendingBuildFailure(id); failing {
+		e := newBuildEvent("failed", task)
+		e.Error = &ServerError{Code: failure.Code, Message: failure.Error}
+		return serveBuildEvents(sub, []BuildEvent{e})
+	}
+
+	// the events of the task in the queue are replayed by its current state,
+	// a new task publishes the "queued" event
+	initial := []BuildEvent{}
+	if e, ok := buildQueue.getTaskEvent(id); ok {
+		initial = append(initial, e)
+	}
+	buildQueue.Add(task, "")
+	return serveBuildEvents(sub, initial)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ije/rex"
+)
+
+func TestBuildEvents(t *testing.T) {
+	task := &BuildTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "react", Version: "18.2.0"},
+		Target:       "es2022",
+	}
+	id := task.ID()
+	all := buildEvents.subscribe("")
+	defer buildEvents.unsubscribe(all)
+	other := buildEvents.subscribe("v1/preact@10.10.0/es2022/preact.js")
+	defer buildEvents.unsubscribe(other)
+
+	// the stage events are published with the build log only
+	task.setStage("install")
+	task.buildLog = newBuildLog(id)
+	task.setStage("build")
+	e := <-all.C
+	if e.Type != "stage" || e.ID != id || e.Stage != "build" || e.Pkg != "react@18.2.0" {
+		t.Fatalf("bad stage event: %+v", e)
+	}
+	if len(all.C) != 0 || len(other.C) != 0 {
+		t.Fatal("unexpected events")
+	}
+
+	sub := buildEvents.subscribe(id)
+	handler := serveBuildEvents(sub, []BuildEvent{newBuildEvent("queued", task)}).(http.Handler)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("bad content type: %s", ct)
+	}
+
+	go func() {
+		task.setStage("store")
+		failed := newBuildEvent("failed", task)
+		failed.Error = newServerError(ErrBuildFailed, "esbuild: boom")
+		buildEvents.publish(failed)
+	}()
+
+	events := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimPrefix(line, "event: "))
+		} else if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"type":"failed"`) {
+			if !strings.Contains(line, `"error":{"code":"build-failed","message":"esbuild: boom"}`) {
+				t.Fatalf("bad failed event: %s", line)
+			}
+		}
+	}
+	if strings.Join(events, ",") != "queued,stage,failed" {
+		t.Fatalf("bad events: %v", events)
+	}
+}
+
+func TestBuildEventsHTTP2(t *testing.T) {
+	task := &BuildTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "preact", Version: "10.10.0"},
+		Target:       "es2022",
+	}
+	sub := buildEvents.subscribe(task.ID())
+	// the response writer of rex can't be flushed
+	handler := &rex.Handler{}
+	handler.Use(func(ctx *rex.Context) interface{} {
+		return serveBuildEvents(sub, []BuildEvent{newBuildEvent("done", task)})
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 || res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("bad response: %s %d %s", res.Proto, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "event: done\n") {
+		t.Fatalf("bad events: %s", data)
+	}
+}
+
+func TestBuildEventsBufferFull(t *testing.T) {
+	task := &BuildTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "vue", Version: "3.2.40"},
+		Target:       "es2022",
+	}
+	sub := buildEvents.subscribe(task.ID())
+	for i := 0; i < cap(sub.C)+10; i++ {
+		buildEvents.publish(newBuildEvent("stage", task))
+	}
+	buildEvents.publish(newBuildEvent("done", task))
+
+	ts := httptest.NewServer(serveBuildEvents(sub, nil).(http.Handler))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream is closed by the final event that is not dropped
+	events := string(data)
+	if n := strings.Count(events, "event: stage\n"); n != cap(sub.C) || strings.LastIndex(events, "event: ") != strings.Index(events, "event: done\n") {
+		t.Fatalf("bad events (%d stages): %s", n, events)
+	}
+}
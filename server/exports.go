@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// orderedMap is a JSON object that keeps the key order, the conditions in the `exports`
+// and `imports` fields of package.json are matched in the object order.
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *orderedMap {
+	return &orderedMap{values: map[string]interface{}{}}
+}
+
+func (m *orderedMap) Keys() []string {
+	return m.keys
+}
+
+func (m *orderedMap) Get(key string) (value interface{}, ok bool) {
+	value, ok = m.values[key]
+	return
+}
+
+func (m *orderedMap) Set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeOrderedJSON decodes the JSON data like `json.Unmarshal` into an `interface{}`,
+// except the objects are decoded as `*orderedMap`.
+func decodeOrderedJSON(data []byte) (v interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	v, err = decodeOrderedJSONValue(dec)
+	if err != nil {
+		return
+	}
+	if _, e := dec.Token(); e != io.EOF {
+		err = fmt.Errorf("invalid character after top-level value")
+	}
+	return
+}
+
+func decodeOrderedJSONValue(dec *json.Decoder) (v interface{}, err error) {
+	token, err := dec.Token()
+	if err != nil {
+		return
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			m := newOrderedMap()
+			for dec.More() {
+				var keyToken json.Token
+				keyToken, err = dec.Token()
+				if err != nil {
+					return
+				}
+				key, ok := keyToken.(string)
+				if !ok {
+					return nil, fmt.Errorf("invalid object key %v", keyToken)
+				}
+				var value interface{}
+				value, err = decodeOrderedJSONValue(dec)
+				if err != nil {
+					return
+				}
+				m.Set(key, value)
+			}
+			_, err = dec.Token()
+			v = m
+		case '[':
+			a := []interface{}{}
+			for dec.More() {
+				var value interface{}
+				value, err = decodeOrderedJSONValue(dec)
+				if err != nil {
+					return
+				}
+				a = append(a, value)
+			}
+			_, err = dec.Token()
+			v = a
+		default:
+			err = fmt.Errorf("unexpected delimiter %v", t)
+		}
+	default:
+		v = t
+	}
+	return
+}
+
+type targetState int
+
+const (
+	targetUndefined targetState = iota
+	targetResolved
+	targetNull
+	targetInvalid
+)
+
+// resolveExportsField resolves the subpath(`.` or `./foo`) with the `exports` field of package.json.
+// see https://nodejs.org/api/esm.html#resolution-algorithm (PACKAGE_EXPORTS_RESOLVE)
+func resolveExportsField(exports interface{}, subpath string, conditions []string) (resolved string, ok bool) {
+	if exports == nil {
+		return
+	}
+	m, isMap := exports.(*orderedMap)
+	if isMap && len(m.keys) > 0 && strings.HasPrefix(m.keys[0], ".") {
+		for _, key := range m.keys {
+			// the `exports` mixes subpaths and conditions
+			if !strings.HasPrefix(key, ".") {
+				return
+			}
+		}
+		return resolveImportsExports(subpath, m, false, conditions)
+	}
+	// the `exports` is a string, an array or a conditions object of the main export
+	if subpath == "." {
+		var state targetState
+		resolved, state = resolvePackageTarget(exports, "", false, conditions)
+		ok = state == targetResolved
+	}
+	return
+}
+
+// resolveImportsField resolves the `#internal` specifier with the `imports` field of package.json,
+// the resolved path is either a path relative to the package dir or a bare specifier.
+// see https://nodejs.org/api/esm.html#resolution-algorithm (PACKAGE_IMPORTS_RESOLVE)
+func resolveImportsField(imports interface{}, specifier string, conditions []string) (resolved string, ok bool) {
+	if !strings.HasPrefix(specifier, "#") || specifier == "#" || strings.HasPrefix(specifier, "#/") {
+		return
+	}
+	m, isMap := imports.(*orderedMap)
+	if !isMap {
+		return
+	}
+	return resolveImportsExports(specifier, m, true, conditions)
+}
+
+// see PACKAGE_IMPORTS_EXPORTS_RESOLVE
+func resolveImportsExports(matchKey string, matchObj *orderedMap, isImports bool, conditions []string) (resolved string, ok bool) {
+	if target, exists := matchObj.Get(matchKey); exists && !strings.ContainsRune(matchKey, '*') {
+		resolved, state := resolvePackageTarget(target, "", isImports, conditions)
+		return resolved, state == targetResolved
+	}
+	expansionKeys := []string{}
+	for _, key := range matchObj.keys {
+		if strings.Count(key, "*") == 1 {
+			expansionKeys = append(expansionKeys, key)
+		}
+	}
+	sort.SliceStable(expansionKeys, func(i, j int) bool {
+		return comparePatternKeys(expansionKeys[i], expansionKeys[j]) < 0
+	})
+	for _, key := range expansionKeys {
+		i := strings.IndexByte(key, '*')
+		patternBase := key[:i]
+		if strings.HasPrefix(matchKey, patternBase) && matchKey != patternBase {
+			patternTrailer := key[i+1:]
+			if patternTrailer == "" || (strings.HasSuffix(matchKey, patternTrailer) && len(matchKey) >= len(key)) {
+				patternMatch := matchKey[len(patternBase) : len(matchKey)-len(patternTrailer)]
+				target, _ := matchObj.Get(key)
+				resolved, state := resolvePackageTarget(target, patternMatch, isImports, conditions)
+				return resolved, state == targetResolved
+			}
+		}
+	}
+	return
+}
+
+// comparePatternKeys sorts the pattern keys by specificity, see PATTERN_KEY_COMPARE
+func comparePatternKeys(a string, b string) int {
+	baseLengthA := strings.IndexByte(a, '*') + 1
+	baseLengthB := strings.IndexByte(b, '*') + 1
+	if baseLengthA > baseLengthB {
+		return -1
+	}
+	if baseLengthB > baseLengthA {
+		return 1
+	}
+	if baseLengthA == 0 {
+		return 1
+	}
+	if baseLengthB == 0 {
+		return -1
+	}
+	if len(a) > len(b) {
+		return -1
+	}
+	if len(b) > len(a) {
+		return 1
+	}
+	return 0
+}
+
+// see PACKAGE_TARGET_RESOLVE
+func resolvePackageTarget(target interface{}, patternMatch string, isImports bool, conditions []string) (string, targetState) {
+	switch t := target.(type) {
+	case string:
+		if !strings.HasPrefix(t, "./") {
+			// only the `imports` can map to a bare specifier
+			if !isImports || strings.HasPrefix(t, "../") || strings.HasPrefix(t, "/") || isRemoteImport(t) || strings.Contains(t, ":") {
+				return "", targetInvalid
+			}
+			if patternMatch != "" {
+				t = strings.ReplaceAll(t, "*", patternMatch)
+			}
+			return t, targetResolved
+		}
+		if hasInvalidSegment(t[2:]) {
+			return "", targetInvalid
+		}
+		if patternMatch != "" {
+			if hasInvalidSegment(patternMatch) {
+				return "", targetInvalid
+			}
+			t = strings.ReplaceAll(t, "*", patternMatch)
+		}
+		return t, targetResolved
+	case *orderedMap:
+		for _, key := range t.keys {
+			if key != "default" && !containsString(conditions, key) {
+				continue
+			}
+			value, _ := t.Get(key)
+			resolved, state := resolvePackageTarget(value, patternMatch, isImports, conditions)
+			if state == targetUndefined {
+				continue
+			}
+			return resolved, state
+		}
+		return "", targetUndefined
+	case []interface{}:
+		if len(t) == 0 {
+			return "", targetNull
+		}
+		lastState := targetUndefined
+		for _, value := range t {
+			resolved, state := resolvePackageTarget(value, patternMatch, isImports, conditions)
+			if state == targetInvalid {
+				lastState = state
+				continue
+			}
+			if state == targetUndefined {
+				continue
+			}
+			return resolved, state
+		}
+		return "", lastState
+	case nil:
+		return "", targetNull
+	}
+	return "", targetInvalid
+}
+
+// hasInvalidSegment checks whether the path has empty, `.`, `..` or `node_modules` segments
+func hasInvalidSegment(p string) bool {
+	for _, s := range strings.Split(strings.ReplaceAll(p, "\\", "/"), "/") {
+		switch strings.ToLower(s) {
+		case "", ".", "..", "node_modules":
+			return true
+		}
+	}
+	return false
+}
+
+// matchExportsSubpath returns the subpath of the `exports` that resolves to the module path,
+// the module path may omit the `.js`/`.mjs` extension.
+func matchExportsSubpath(exports interface{}, modulePath string, conditionsList ...[]string) (subpath string, ok bool) {
+	m, isMap := exports.(*orderedMap)
+	if !isMap || len(m.keys) == 0 || !strings.HasPrefix(m.keys[0], ".") {
+		return
+	}
+	candidates := []string{modulePath, modulePath + ".js", modulePath + ".mjs"}
+	for _, key := range m.keys {
+		if key == "." || !strings.HasPrefix(key, "./") {
+			continue
+		}
+		target, _ := m.Get(key)
+		for _, conditions := range conditionsList {
+			switch strings.Count(key, "*") {
+			case 0:
+				resolved, state := resolvePackageTarget(target, "", false, conditions)
+				if state == targetResolved && containsString(candidates, resolved) {
+					return key, true
+				}
+			case 1:
+				// resolve the target with the `*` placeholder, then match the module path with the template
+				template, state := resolvePackageTarget(target, "*", false, conditions)
+				if state != targetResolved || strings.Count(template, "*") != 1 {
+					continue
+				}
+				prefix, suffix := utils.SplitByFirstByte(template, '*')
+				for _, candidate := range candidates {
+					if strings.HasPrefix(candidate, prefix) && strings.HasSuffix(candidate, suffix) && len(candidate) > len(prefix)+len(suffix) {
+						match := candidate[len(prefix) : len(candidate)-len(suffix)]
+						if !hasInvalidSegment(match) {
+							return strings.Replace(key, "*", match, 1), true
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// getExportsConditions returns the conditions to resolve the ES module entry of the package,
+// the custom conditions of the `?conditions` query take precedence.
+func getExportsConditions(target string, isDev bool, custom []string) []string {
+	conditions := []string{"es2015", "module", "import", "browser", "worker"}
+	if target == "deno" {
+		conditions = []string{"deno", "es2015", "module", "import", "worker", "browser"}
+	}
+	if isDev {
+		conditions = append(conditions, "development")
+	} else {
+		conditions = append(conditions, "production")
+	}
+	return append(append([]string{}, custom...), conditions...)
+}
+
+// the conditions to resolve the CommonJS entry of the package
+var requireConditions = []string{"require", "node"}
+
+// getRequireConditions returns the conditions to resolve the CommonJS entry of the package
+func getRequireConditions(custom []string) []string {
+	return append(append([]string{}, custom...), requireConditions...)
+}
+
+// the conditions to resolve the types entry of the package
+var typesConditions = []string{"types", "typings"}
+
+// see https://nodejs.org/api/packages.html
+func resolvePackageExports(p *NpmPackage, subpath string, target string, isDev bool, custom []string) (resolved bool) {
+	if p.DefinedExports == nil {
+		return
+	}
+	conditions := getExportsConditions(target, isDev, custom)
+	module, hasModule := resolveExportsField(p.DefinedExports, subpath, conditions)
+	main, hasMain := resolveExportsField(p.DefinedExports, subpath, getRequireConditions(custom))
+	if !hasModule && !hasMain {
+		return
+	}
+	// the same entry for both `import` and `require` is a CommonJS module unless the package type is `module`
+	if hasModule && hasMain && module == main && p.Type != "module" && !strings.HasSuffix(module, ".mjs") {
+		hasModule = false
+	}
+	if hasModule {
+		p.Module = module
+	}
+	if hasMain {
+		p.Main = main
+	}
+	if types, ok := resolveExportsField(p.DefinedExports, subpath, typesConditions); ok && isDtsFile(types) {
+		p.Types = types
+	} else if types, ok := resolveExportsField(p.DefinedExports, subpath, append(typesConditions, conditions...)); ok && isDtsFile(types) {
+		p.Types = types
+	}
+	return true
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isDtsFile(filename string) bool {
+	return endsWith(filename, ".d.ts", ".d.mts", ".d.cts")
+}
+
+// findPackageJSON returns the dir and the nearest package.json of the dir in the working directory,
+// the package.json without `name` is skipped if `named` is true.
+func findPackageJSON(wd string, dir string, named bool) (pkgDir string, pkg *NpmPackage) {
+	for dir != wd && strings.HasPrefix(dir, wd) {
+		pkgJsonPath := path.Join(dir, "package.json")
+		if fileExists(pkgJsonPath) {
+			var p NpmPackage
+			if utils.ParseJSONFile(pkgJsonPath, &p) == nil && (!named || p.Name != "") {
+				return dir, &p
+			}
+		}
+		dir = path.Dir(dir)
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func parseTestPackage(t *testing.T, pkgJson string) NpmPackage {
+	var p NpmPackage
+	err := json.Unmarshal([]byte(pkgJson), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestResolveExportsField(t *testing.T) {
+	esmConditions := []string{"import", "browser"}
+	cjsConditions := []string{"require", "node"}
+
+	tests := []struct {
+		name       string
+		pkgJson    string
+		subpath    string
+		conditions []string
+		expected   string
+	}{
+		{"string", `{"exports": "./index.js"}`, ".", esmConditions, "./index.js"},
+		{"string with subpath", `{"exports": "./index.js"}`, "./foo", esmConditions, ""},
+		{"main conditions", `{"exports": {"import": "./index.mjs", "require": "./index.cjs"}}`, ".", esmConditions, "./index.mjs"},
+		{"main conditions require", `{"exports": {"import": "./index.mjs", "require": "./index.cjs"}}`, ".", cjsConditions, "./index.cjs"},
+		{"object order", `{"exports": {"default": "./index.js", "import": "./index.mjs"}}`, ".", esmConditions, "./index.js"},
+		{"no default", `{"exports": {"node": "./node.js"}}`, ".", esmConditions, ""},
+		{"default always matches", `{"exports": {"node": "./node.js", "default": "./index.js"}}`, ".", nil, "./index.js"},
+		{
+			"nested conditions",
+			`{"exports": {".": {"node": {"import": "./node.mjs", "require": "./node.cjs"}, "browser": {"import": "./browser.mjs", "require": "./browser.cjs"}, "default": "./index.js"}}}`,
+			".", esmConditions, "./browser.mjs",
+		},
+		{
+			"nested conditions fallthrough",
+			`{"exports": {".": {"browser": {"worker": "./worker.js"}, "default": "./index.js"}}}`,
+			".", esmConditions, "./index.js",
+		},
+		{"array fallback", `{"exports": {".": ["./invalid/../index.js", "./index.js"]}}`, ".", esmConditions, "./index.js"},
+		{"array conditions", `{"exports": {".": [{"worker": "./worker.js"}, "./index.js"]}}`, ".", esmConditions, "./index.js"},
+		{"null target", `{"exports": {".": "./index.js", "./internal": null}}`, "./internal", esmConditions, ""},
+		{"null in conditions", `{"exports": {".": {"browser": null, "default": "./index.js"}}}`, ".", esmConditions, ""},
+		{"invalid target", `{"exports": {".": "../index.js"}}`, ".", esmConditions, ""},
+		{"node_modules target", `{"exports": {"./foo": "./node_modules/foo/index.js"}}`, "./foo", esmConditions, ""},
+		{"bare target", `{"exports": {".": "lodash"}}`, ".", esmConditions, ""},
+		{"mixed keys", `{"exports": {".": "./index.js", "import": "./index.mjs"}}`, ".", esmConditions, ""},
+		{"subpath", `{"exports": {".": "./index.js", "./compat": {"import": "./compat/index.mjs", "require": "./compat/index.js"}}}`, "./compat", esmConditions, "./compat/index.mjs"},
+		{"pattern", `{"exports": {"./*": "./dist/*.js"}}`, "./foo/bar", esmConditions, "./dist/foo/bar.js"},
+		{"pattern conditions", `{"exports": {"./lib/languages/*": {"require": "./lib/languages/*.js", "import": "./es/languages/*.js"}}}`, "./lib/languages/go", esmConditions, "./es/languages/go.js"},
+		{"pattern trailer", `{"exports": {"./features/*.js": "./src/features/*.js"}}`, "./features/x.js", esmConditions, "./src/features/x.js"},
+		{"pattern trailer mismatch", `{"exports": {"./features/*.js": "./src/features/*.js"}}`, "./features/x.css", esmConditions, ""},
+		{"pattern multiple replacements", `{"exports": {"./*": "./*/*.js"}}`, "./foo", esmConditions, "./foo/foo.js"},
+		{"pattern exclusion", `{"exports": {"./features/*": "./src/features/*.js", "./features/private/*": null}}`, "./features/private/x", esmConditions, ""},
+		{"pattern specificity", `{"exports": {"./*": "./dist/*.js", "./icons/*": "./dist/icons/*.svg"}}`, "./icons/home", esmConditions, "./dist/icons/home.svg"},
+		{"exact key before pattern", `{"exports": {"./*": "./dist/*.js", "./package.json": "./package.json"}}`, "./package.json", esmConditions, "./package.json"},
+		{"pattern invalid match", `{"exports": {"./*": "./dist/*.js"}}`, "./../secret", esmConditions, ""},
+		{
+			"react",
+			`{"exports": {".": {"react-server": "./react.shared-subset.js", "default": "./index.js"}, "./package.json": "./package.json", "./jsx-runtime": "./jsx-runtime.js", "./jsx-dev-runtime": "./jsx-dev-runtime.js"}}`,
+			"./jsx-runtime", esmConditions, "./jsx-runtime.js",
+		},
+		{
+			"react server",
+			`{"exports": {".": {"react-server": "./react.shared-subset.js", "default": "./index.js"}}}`,
+			".", append([]string{"react-server"}, esmConditions...), "./react.shared-subset.js",
+		},
+		{
+			"preact",
+			`{"exports": {".": {"types": "./src/index.d.ts", "browser": "./dist/preact.module.js", "umd": "./dist/preact.umd.js", "import": "./dist/preact.mjs", "require": "./dist/preact.js"}, "./hooks": {"types": "./hooks/src/index.d.ts", "browser": "./hooks/dist/hooks.module.js", "import": "./hooks/dist/hooks.mjs", "require": "./hooks/dist/hooks.js"}}}`,
+			"./hooks", esmConditions, "./hooks/dist/hooks.module.js",
+		},
+		{
+			"uuid",
+			`{"exports": {".": {"node": {"module": "./dist/esm-node/index.js", "require": "./dist/index.js", "import": "./wrapper.mjs"}, "default": "./dist/esm-browser/index.js"}, "./package.json": "./package.json"}}`,
+			".", cjsConditions, "./dist/index.js",
+		},
+	}
+
+	for _, tt := range tests {
+		p := parseTestPackage(t, tt.pkgJson)
+		resolved, ok := resolveExportsField(p.DefinedExports, tt.subpath, tt.conditions)
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("%s: expected not resolved, got '%s'", tt.name, resolved)
+			}
+		} else if !ok || resolved != tt.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tt.name, tt.expected, resolved)
+		}
+	}
+}
+
+func TestResolveImportsField(t *testing.T) {
+	p := parseTestPackage(t, `{
+		"imports": {
+			"#dep": {"node": "dep-node-native", "default": "./dep-polyfill.js"},
+			"#internal/*": "./src/internal/*.js",
+			"#internal/private/*": null,
+			"#invalid": "../outside.js"
+		}
+	}`)
+	tests := []struct {
+		specifier  string
+		conditions []string
+		expected   string
+	}{
+		{"#dep", []string{"node", "import"}, "dep-node-native"},
+		{"#dep", []string{"browser", "import"}, "./dep-polyfill.js"},
+		{"#internal/utils", nil, "./src/internal/utils.js"},
+		{"#internal/private/key", nil, ""},
+		{"#invalid", nil, ""},
+		{"#missing", nil, ""},
+		{"#", nil, ""},
+	}
+	for _, tt := range tests {
+		resolved, ok := resolveImportsField(p.DefinedImports, tt.specifier, tt.conditions)
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("%s: expected not resolved, got '%s'", tt.specifier, resolved)
+			}
+		} else if !ok || resolved != tt.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tt.specifier, tt.expected, resolved)
+		}
+	}
+}
+
+func TestResolvePackageExports(t *testing.T) {
+	p := parseTestPackage(t, `{
+		"name": "pkg",
+		"main": "./lib/index.js",
+		"exports": {
+			".": {
+				"types": "./types/index.d.ts",
+				"import": "./esm/index.mjs",
+				"require": "./lib/index.js"
+			},
+			"./core": "./lib/core.js",
+			"./utils/*": {
+				"import": {"types": "./types/utils/*.d.mts", "default": "./esm/utils/*.mjs"},
+				"require": "./lib/utils/*.js"
+			}
+		}
+	}`)
+
+	np := fixNpmPackage(p, "es2020", false, nil)
+	if np.Module != "./esm/index.mjs" || np.Main != "./lib/index.js" || np.Types != "./types/index.d.ts" {
+		t.Fatalf("bad main export: %s, %s, %s", np.Module, np.Main, np.Types)
+	}
+
+	sub := p
+	sub.Module, sub.Main, sub.Types = "", "", ""
+	if !resolvePackageExports(&sub, "./core", "es2020", false, nil) || sub.Module != "" || sub.Main != "./lib/core.js" {
+		t.Fatalf("a string export of the commonjs package should be the main entry: %s, %s", sub.Module, sub.Main)
+	}
+
+	sub = p
+	sub.Module, sub.Main, sub.Types = "", "", ""
+	if !resolvePackageExports(&sub, "./utils/a", "es2020", false, nil) || sub.Module != "./esm/utils/a.mjs" || sub.Main != "./lib/utils/a.js" || sub.Types != "./types/utils/a.d.mts" {
+		t.Fatalf("bad pattern export: %s, %s, %s", sub.Module, sub.Main, sub.Types)
+	}
+
+	// the order of conditions should be kept after caching
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached NpmPackage
+	err = json.Unmarshal(data, &cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := cached.DefinedExports.(*orderedMap).Keys()
+	if len(keys) != 3 || keys[0] != "." || keys[1] != "./core" || keys[2] != "./utils/*" {
+		t.Fatalf("bad exports keys after caching: %v", keys)
+	}
+}
+
+func TestMatchExportsSubpath(t *testing.T) {
+	p := parseTestPackage(t, `{
+		"exports": {
+			".": "./index.js",
+			"./lib/core": {"require": "./lib/core.js", "import": "./es/core.js"},
+			"./lib/languages/*": {"require": "./lib/languages/*.js", "import": "./es/languages/*.js"}
+		}
+	}`)
+	tests := []struct {
+		modulePath string
+		expected   string
+	}{
+		{"./es/core", "./lib/core"},
+		{"./lib/core.js", "./lib/core"},
+		{"./es/languages/go", "./lib/languages/go"},
+		{"./lib/languages/rust.js", "./lib/languages/rust"},
+		{"./index", ""},
+		{"./es/utils", ""},
+	}
+	for _, tt := range tests {
+		subpath, ok := matchExportsSubpath(p.DefinedExports, tt.modulePath, []string{"import"}, requireConditions)
+		if tt.expected == "" {
+			if ok {
+				t.Errorf("%s: expected not matched, got '%s'", tt.modulePath, subpath)
+			}
+		} else if !ok || subpath != tt.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tt.modulePath, tt.expected, subpath)
+		}
+	}
+}
+
+func TestBrowserField(t *testing.T) {
+	p := parseTestPackage(t, `{
+		"main": "./lib/index.js",
+		"module": "./es/index.js",
+		"browser": {
+			"./lib/index.js": "./lib/browser.js",
+			"./es/index": "./es/browser.js",
+			"./lib/fs.js": false,
+			"stream": "readable-stream"
+		}
+	}`)
+	np := fixNpmPackage(p, "es2020", false, nil)
+	if np.Module != "./es/browser.js" || np.Main != "./lib/browser.js" {
+		t.Fatalf("bad browser entries: %s, %s", np.Module, np.Main)
+	}
+	np = fixNpmPackage(p, "node", false, nil)
+	if np.Module != "./es/index.js" || np.Main != "./lib/index.js" {
+		t.Fatalf("the browser field should not apply to node target: %s, %s", np.Module, np.Main)
+	}
+	if v, ok := lookupBrowserMap(p.Browser, "./lib/fs"); !ok || v != false {
+		t.Fatalf("bad browser mapping of './lib/fs': %v", v)
+	}
+	if v, ok := lookupBrowserMap(p.Browser, "stream"); !ok || v != "readable-stream" {
+		t.Fatalf("bad browser mapping of 'stream': %v", v)
+	}
+	if _, ok := lookupBrowserMap(p.Browser, "./lib/path"); ok {
+		t.Fatal("unexpected browser mapping of './lib/path'")
+	}
+
+	p = parseTestPackage(t, `{"main": "./index.js", "browser": "./browser.js"}`)
+	np = fixNpmPackage(p, "es2020", false, nil)
+	if np.Main != "./browser.js" {
+		t.Fatalf("bad browser main: %s", np.Main)
+	}
+}
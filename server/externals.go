@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ije/esbuild-internal/helpers"
+	"github.com/ije/esbuild-internal/js_ast"
+	"github.com/ije/esbuild-internal/js_parser"
+	"github.com/ije/esbuild-internal/logger"
+	"github.com/ije/esbuild-internal/test"
+)
+
+const externalPrefix = "__ESM_SH_EXTERNAL:"
+
+type externalRefKind int
+
+const (
+	// import/export statements and `import()` expressions
+	externalImport externalRefKind = iota
+	// `require()` calls, with the accessed member like `require("htmlparser").Parser`
+	externalRequire
+	// other string literals of the external, like `require.resolve("x")`
+	externalString
+)
+
+// externalRef defines a reference of the external module in the build output,
+// the `[start, end)` range is the code to be replaced.
+type externalRef struct {
+	Kind   externalRefKind
+	Start  int32
+	End    int32
+	Member string
+}
+
+// findExternalRefs parses the build output and returns the references of the external modules
+// grouped by the module name.
+func findExternalRefs(code []byte) (refs map[string][]externalRef, err error) {
+	if !bytes.Contains(code, []byte(externalPrefix)) {
+		return
+	}
+
+	source := test.SourceForTest(string(code))
+	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug)
+	ast, ok := js_parser.Parse(log, source, js_parser.Options{})
+	if !ok {
+		msg := "failed to parse the build output"
+		for _, m := range log.Done() {
+			if m.Kind == logger.Error {
+				msg += ": " + m.Data.Text
+				break
+			}
+		}
+		err = errors.New(msg)
+		return
+	}
+
+	v := &externalsVisitor{source: &source, refs: map[string][]externalRef{}}
+	for _, record := range ast.ImportRecords {
+		if name := strings.TrimPrefix(record.Path.Text, externalPrefix); name != record.Path.Text {
+			v.add(name, externalRef{Kind: externalImport, Start: record.Range.Loc.Start, End: record.Range.End()})
+		}
+	}
+	walker := &astVisitor{expr: v.visitExpr}
+	for _, part := range ast.Parts {
+		walker.visitStmts(part.Stmts)
+	}
+	refs = v.refs
+	return
+}
+
+// rewriteExternalRefs replaces the code of the references in one pass
+func rewriteExternalRefs(code []byte, refs []externalRef, replacements []string) []byte {
+	indexes := make([]int, len(refs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return refs[indexes[i]].Start < refs[indexes[j]].Start
+	})
+
+	buf := bytes.NewBuffer(nil)
+	offset := int32(0)
+	for _, i := range indexes {
+		ref := refs[i]
+		if ref.Start < offset {
+			// overlapped references can't be generated by esbuild
+			continue
+		}
+		buf.Write(code[offset:ref.Start])
+		buf.WriteString(replacements[i])
+		offset = ref.End
+	}
+	buf.Write(code[offset:])
+	return buf.Bytes()
+}
+
+type externalsVisitor struct {
+	source *logger.Source
+	refs   map[string][]externalRef
+}
+
+func (v *externalsVisitor) add(name string, ref externalRef) {
+	v.refs[name] = append(v.refs[name], ref)
+}
+
+// matchRequire checks whether the expression is a call like `__require("__ESM_SH_EXTERNAL:name")`
+func (v *externalsVisitor) matchRequire(expr js_ast.Expr) (name string, call *js_ast.ECall, ok bool) {
+	call, ok = expr.Data.(*js_ast.ECall)
+	if !ok || len(call.Args) != 1 || call.OptionalChain != js_ast.OptionalChainNone {
+		return "", nil, false
+	}
+	if _, ok = call.Target.Data.(*js_ast.EIdentifier); !ok {
+		return "", nil, false
+	}
+	str, ok := call.Args[0].Data.(*js_ast.EString)
+	if !ok {
+		return "", nil, false
+	}
+	name = helpers.UTF16ToString(str.Value)
+	if !strings.HasPrefix(name, externalPrefix) {
+		return "", nil, false
+	}
+	return strings.TrimPrefix(name, externalPrefix), call, true
+}
+
+func (v *externalsVisitor) visitExpr(expr js_ast.Expr) bool {
+	switch e := expr.Data.(type) {
+	case *js_ast.ECall:
+		if name, call, ok := v.matchRequire(expr); ok {
+			v.add(name, externalRef{Kind: externalRequire, Start: expr.Loc.Start, End: call.CloseParenLoc.Start + 1})
+			return false
+		}
+	case *js_ast.EDot:
+		// member access of the required module like `require("htmlparser").Parser`
+		if name, _, ok := v.matchRequire(e.Target); ok && e.OptionalChain == js_ast.OptionalChainNone {
+			v.add(name, externalRef{Kind: externalRequire, Start: expr.Loc.Start, End: e.NameLoc.Start + int32(len(e.Name)), Member: e.Name})
+			return false
+		}
+	case *js_ast.EString:
+		if name := helpers.UTF16ToString(e.Value); strings.HasPrefix(name, externalPrefix) {
+			r := v.source.RangeOfString(expr.Loc)
+			v.add(strings.TrimPrefix(name, externalPrefix), externalRef{Kind: externalString, Start: r.Loc.Start, End: r.End()})
+		}
+	}
+	return true
+}
+
+// getRequireMode returns how the `require()` call of the external module is imported:
+//   - "*": an es module without `default` export, use star import
+//   - "all": an es module with `default` export, use both default and star imports
+//   - "__esModule": a cjs module with `default` export, use star import with `__esModule`
+//   - "default": use default import
+//
+// the export names of the module are returned as well to import the accessed member directly.
+func (task *BuildTask) getRequireMode(name string) (mode string, exports []string) {
+	mode = "default"
+	if builtInNodeModules[name] {
+		return
+	}
+	pkg, _, err := parsePkg(name, task.Before)
+	if err != nil {
+		return
+	}
+	pkgJsonPath := path.Join(task.wd, "node_modules", pkg.Name, "package.json")
+	if !task.Before.IsZero() && !fileExists(pkgJsonPath) {
+		err = pinYarnResolutions(task.wd, pkg.Name, pkg.Version, task.Before)
+	}
+	if err == nil && !fileExists(pkgJsonPath) {
+		for i := 0; i < 3; i++ {
+			err = task.yarnAdd(fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
+			if err == nil && !fileExists(pkgJsonPath) {
+				defer yarnCacheClean(task.wd, pkg.Name)
+				err = fmt.Errorf("yarnAdd(%s): package.json not found", pkg)
+			}
+			if err == nil {
+				break
+			}
+			if i < 2 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	dep, depNpm, err := initModule(task.wd, *pkg, task.Target, task.DevMode, task.Conditions)
+	if err != nil {
+		return
+	}
+	exports = dep.Exports
+	if depNpm.Module != "" && !dep.ExportDefault {
+		mode = "*"
+	} else if depNpm.Module != "" && dep.ExportDefault {
+		mode = "all"
+	} else if depNpm.Module == "" && dep.ExportDefault {
+		mode = "__esModule"
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package server
+
+import "testing"
+
+func TestFindExternalRefs(t *testing.T) {
+	code := []byte(`import a from "__ESM_SH_EXTERNAL:react";` +
+		`var s=__require("__ESM_SH_EXTERNAL:htmlparser").Parser,o=__require("__ESM_SH_EXTERNAL:htmlparser");` +
+		`var x="(__ESM_SH_EXTERNAL:fake)",r=__require.resolve("__ESM_SH_EXTERNAL:path");` +
+		`function f(){return import("__ESM_SH_EXTERNAL:lazy").then(m=>m)}` +
+		`export{a,s,o,x,r,f};`)
+
+	refs, err := findExternalRefs(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 4 || len(refs["react"]) != 1 || len(refs["htmlparser"]) != 2 || len(refs["path"]) != 1 || len(refs["lazy"]) != 1 {
+		t.Fatalf("bad refs: %v", refs)
+	}
+	if ref := refs["htmlparser"][0]; ref.Kind != externalRequire || ref.Member != "Parser" {
+		t.Fatalf("bad member ref: %+v", ref)
+	}
+	if ref := refs["path"][0]; ref.Kind != externalString {
+		t.Fatalf("bad string ref: %+v", ref)
+	}
+
+	allRefs := []externalRef{}
+	replacements := []string{}
+	for name, list := range refs {
+		for _, ref := range list {
+			allRefs = append(allRefs, ref)
+			switch {
+			case ref.Kind != externalRequire:
+				replacements = append(replacements, `"/`+name+`"`)
+			case ref.Member != "":
+				replacements = append(replacements, "__"+name+"$"+ref.Member)
+			default:
+				replacements = append(replacements, "__"+name+"$")
+			}
+		}
+	}
+	expected := `import a from "/react";` +
+		`var s=__htmlparser$Parser,o=__htmlparser$;` +
+		`var x="(__ESM_SH_EXTERNAL:fake)",r=__require.resolve("/path");` +
+		`function f(){return import("/lazy").then(m=>m)}` +
+		`export{a,s,o,x,r,f};`
+	if output := string(rewriteExternalRefs(code, allRefs, replacements)); output != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", output, expected)
+	}
+}
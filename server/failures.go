@@ -0,0 +1,128 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+// BuildFailure is the record of a failed build, the build is not retried until `RetryAt`
+type BuildFailure struct {
+	ID      string    `json:"id"`
+	Code    ErrorCode `json:"code"`
+	Error   string    `json:"error"`
+	Count   int       `json:"count"`
+	Time    time.Time `json:"time"`
+	RetryAt time.Time `json:"retryAt"`
+}
+
+const (
+	minFailureBackoff = time.Minute
+	maxFailureBackoff = 24 * time.Hour
+)
+
+// getFailureBackoff returns the backoff of the build that failed `count` times in a row,
+// it doubles on every failure.
+func getFailureBackoff(count int) time.Duration {
+	backoff := minFailureBackoff
+	for i := 1; i < count && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailureBackoff {
+		backoff = maxFailureBackoff
+	}
+	return backoff
+}
+
+// recordBuildFailure records the failure of the build, the backoff grows with the failures in a row
+func recordBuildFailure(id string, buildErr error) (f *BuildFailure, err error) {
+	count := 1
+	if prev, e := findBuildFailure(id); e == nil {
+		count = prev.Count + 1
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	f = &BuildFailure{
+		ID:      id,
+		Code:    getErrorCode(buildErr),
+		Error:   buildErr.Error(),
+		Count:   count,
+		Time:    now,
+		RetryAt: now.Add(getFailureBackoff(count)),
+	}
+	err = db.Put("failure:"+id, "failure", storage.Store{
+		"id":      f.ID,
+		"code":    string(f.Code),
+		"error":   f.Error,
+		"count":   strconv.Itoa(f.Count),
+		"time":    strconv.FormatInt(f.Time.Unix(), 10),
+		"retryAt": strconv.FormatInt(f.RetryAt.Unix(), 10),
+	})
+	return
+}
+
+func parseBuildFailure(store storage.Store) *BuildFailure {
+	count, _ := strconv.Atoi(store["count"])
+	t, _ := strconv.ParseInt(store["time"], 10, 64)
+	retryAt, _ := strconv.ParseInt(store["retryAt"], 10, 64)
+	code := ErrorCode(store["code"])
+	if code == "" {
+		code = ErrBuildFailed
+	}
+	return &BuildFailure{
+		ID:      store["id"],
+		Code:    code,
+		Error:   store["error"],
+		Count:   count,
+		Time:    time.Unix(t, 0).UTC(),
+		RetryAt: time.Unix(retryAt, 0).UTC(),
+	}
+}
+
+// findBuildFailure returns the failure record of the build
+func findBuildFailure(id string) (f *BuildFailure, err error) {
+	store, _, err := db.Get("failure:" + id)
+	if err != nil {
+		return
+	}
+	f = parseBuildFailure(store)
+	return
+}
+
+// findPendingBuildFailure returns the failure record of the build that is still in the backoff
+func findPendingBuildFailure(id string) (f *BuildFailure, ok bool) {
+	f, err := findBuildFailure(id)
+	if err != nil || !time.Now().Before(f.RetryAt) {
+		return nil, false
+	}
+	return f, true
+}
+
+// clearBuildFailure removes the failure record of the build
+func clearBuildFailure(id string) error {
+	_, _, err := db.Get("failure:" + id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	return db.Delete("failure:" + id)
+}
+
+// listBuildFailures returns the failure records, the latest failure first
+func listBuildFailures() (list []*BuildFailure, err error) {
+	items, err := db.List("failure")
+	if err != nil {
+		return
+	}
+	list = make([]*BuildFailure, len(items))
+	for i, item := range items {
+		list[i] = parseBuildFailure(item.Store)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+	return
+}
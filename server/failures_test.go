@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestBuildFailures(t *testing.T) {
+	for count, backoff := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		20: 24 * time.Hour,
+	} {
+		if d := getFailureBackoff(count); d != backoff {
+			t.Fatalf("bad backoff of %d failures: %v", count, d)
+		}
+	}
+
+	savedDB := db
+	defer func() { db = savedDB }()
+	var err error
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	id := "v1/broken@1.0.0/es2022/broken.js"
+	if _, failing := findPendingBuildFailure(id); failing {
+		t.Fatal("should not have the failure record")
+	}
+	recordBuildFailure(id, errors.New("esbuild: boom"))
+	f, err := recordBuildFailure(id, asBuildError(errors.New("esbuild: boom")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Count != 2 || f.RetryAt.Sub(f.Time) != 2*time.Minute {
+		t.Fatalf("bad failure record: %+v", f)
+	}
+	f, failing := findPendingBuildFailure(id)
+	if !failing || f.Code != ErrBuildFailed || f.Error != "esbuild: boom" || f.ID != id {
+		t.Fatalf("bad pending failure: %+v", f)
+	}
+	list, err := listBuildFailures()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("bad failure list: %v %v", list, err)
+	}
+	if err = clearBuildFailure(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, failing := findPendingBuildFailure(id); failing {
+		t.Fatal("the failure record should be cleared")
+	}
+	if err = clearBuildFailure(id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+var esbuildVersion = getEsbuildVersion()
+
+// BuildLock records the dependency resolution of a build, a rebuild of the same build ID
+// reuses the record to produce the identical output. The `resolutions` are the versions of
+// the packages that yarn installed transitively, they are pinned for the installs of the rebuild.
+type BuildLock struct {
+	lock         sync.Mutex
+	Esbuild      string            `json:"esbuild"`
+	DenoStd      string            `json:"denoStd,omitempty"`
+	Polyfills    map[string]string `json:"polyfills,omitempty"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+	Resolutions  map[string]string `json:"resolutions,omitempty"`
+}
+
+func newBuildLock() *BuildLock {
+	return &BuildLock{
+		Esbuild:      esbuildVersion,
+		Polyfills:    map[string]string{},
+		Dependencies: map[string]string{},
+	}
+}
+
+// findBuildLock returns the resolution record of the build, or a new record if the build
+// has never been built
+func findBuildLock(id string) *BuildLock {
+	store, _, err := db.Get("lock:" + id)
+	if err == nil {
+		var lock BuildLock
+		if json.Unmarshal([]byte(store["lock"]), &lock) == nil {
+			if lock.Polyfills == nil {
+				lock.Polyfills = map[string]string{}
+			}
+			if lock.Dependencies == nil {
+				lock.Dependencies = map[string]string{}
+			}
+			return &lock
+		}
+	} else if err != storage.ErrNotFound {
+		log.Errorf("db: %v", err)
+	}
+	return newBuildLock()
+}
+
+// store records the lock of the build, the lock is stored once per build ID and not
+// in the module meta
+func (l *BuildLock) store(id string) {
+	l.lock.Lock()
+	l.Esbuild = esbuildVersion
+	data := utils.MustEncodeJSON(l)
+	l.lock.Unlock()
+
+	err := db.Put("lock:"+id, "lock", storage.Store{"lock": string(data)})
+	if err != nil {
+		log.Errorf("db: %v", err)
+	}
+}
+
+// getDenoStdVersion returns the recorded deno std version, or records the current one
+func (l *BuildLock) getDenoStdVersion() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.DenoStd == "" {
+		l.DenoStd = denoStdVersion
+	}
+	return l.DenoStd
+}
+
+// resolve returns the recorded version of the package, or the given range if not recorded
+func (l *BuildLock) resolve(records map[string]string, name string, versionRange string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if version, ok := records[name]; ok {
+		return version
+	}
+	return versionRange
+}
+
+func (l *BuildLock) record(records map[string]string, name string, version string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	records[name] = version
+}
+
+// checkEsbuildVersion returns a warning if the lock was recorded with another esbuild version,
+// the output of the rebuild may differ from the recorded build in that case.
+func (l *BuildLock) checkEsbuildVersion() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.Esbuild != "" && l.Esbuild != esbuildVersion {
+		return fmt.Sprintf("the build was locked with esbuild %s but is rebuilt with esbuild %s, the output may differ", l.Esbuild, esbuildVersion)
+	}
+	return ""
+}
+
+// pinResolutions pins the recorded versions of the transitive dependencies in the package.json
+// of the working directory, it's called before each `yarn add` of the build.
+func (l *BuildLock) pinResolutions(wd string) error {
+	l.lock.Lock()
+	resolutions := make(map[string]string, len(l.Resolutions))
+	for k, v := range l.Resolutions {
+		resolutions[k] = v
+	}
+	l.lock.Unlock()
+
+	if len(resolutions) == 0 {
+		return nil
+	}
+	return writeYarnResolutions(wd, resolutions)
+}
+
+// recordResolutions records the versions of the installed dependency tree in the working directory
+func (l *BuildLock) recordResolutions(wd string) error {
+	edges, err := readInstalledDependencies(wd)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.Resolutions = toYarnResolutions(edges)
+	return nil
+}
+
+func getEsbuildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/evanw/esbuild" {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
@@ -18,15 +18,20 @@ import (
 
 // ESM defines the ES Module meta
 type ModuleMeta struct {
-	Exports       []string `json:"-"`
-	ExportDefault bool     `json:"d"`
-	CJS           bool     `json:"c"`
-	TypesOnly     bool     `json:"o"`
-	Dts           string   `json:"t"`
-	PackageCSS    bool     `json:"s"`
+	Exports       []string            `json:"-"`
+	ExportDefault bool                `json:"d"`
+	CJS           bool                `json:"c"`
+	TypesOnly     bool                `json:"o"`
+	Dts           string              `json:"t"`
+	PackageCSS    bool                `json:"s"`
+	Imports       []string            `json:"i,omitempty"`
+	Preloads      []string            `json:"p,omitempty"`
+	Metafile      string              `json:"m,omitempty"`
+	Warnings      []string            `json:"w,omitempty"`
+	Verification  *ModuleVerification `json:"v,omitempty"`
 }
 
-func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta, npm *NpmPackage, err error) {
+func initModule(wd string, pkg Pkg, target string, isDev bool, conditions []string) (esm *ModuleMeta, npm *NpmPackage, err error) {
 	packageDir := path.Join(wd, "node_modules", pkg.Name)
 	packageFile := path.Join(packageDir, "package.json")
 
@@ -36,7 +41,7 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 		return
 	}
 
-	npm = fixNpmPackage(p, target, isDev)
+	npm = fixNpmPackage(p, target, isDev, conditions)
 	esm = &ModuleMeta{}
 
 	defer func() {
@@ -71,7 +76,7 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 				if err != nil {
 					return
 				}
-				np := fixNpmPackage(p, target, isDev)
+				np := fixNpmPackage(p, target, isDev, conditions)
 				if np.Module != "" {
 					npm.Module = path.Join(pkg.Submodule, np.Module)
 				} else {
@@ -93,55 +98,30 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 					npm.Types = pkg.Submodule + ".d.ts"
 				}
 			} else {
-				var resolved bool
-				if p.DefinedExports != nil {
-					if m, ok := p.DefinedExports.(map[string]interface{}); ok {
-						for name, defines := range m {
-							if name == "./"+pkg.Submodule {
-								/**
-								  exports: {
-								    "./lib/core": {
-								      "require": "./lib/core.js",
-								      "import": "./es/core.js"
-								    }
-								  }
-								*/
-								resolvePackageExports(npm, defines, target, isDev)
-								resolved = true
-								break
-							} else if strings.HasSuffix(name, "/*") && strings.HasPrefix("./"+pkg.Submodule, strings.TrimSuffix(name, "*")) {
-								/**
-								  exports: {
-								    "./lib/languages/*": {
-								      "require": "./lib/languages/*.js",
-								      "import": "./es/languages/*.js"
-								    },
-								  }
-								*/
-								suffix := strings.TrimPrefix("./"+pkg.Submodule, strings.TrimSuffix(name, "*"))
-								hasDefines := false
-								if m, ok := defines.(map[string]interface{}); ok {
-									newDefines := map[string]interface{}{}
-									for key, value := range m {
-										if s, ok := value.(string); ok && s != name {
-											newDefines[key] = strings.Replace(s, "*", suffix, -1)
-											hasDefines = true
-										}
-									}
-									defines = newDefines
-								} else if s, ok := defines.(string); ok && name != s {
-									defines = strings.Replace(s, "*", suffix, -1)
-									hasDefines = true
-								}
-								if hasDefines {
-									resolvePackageExports(npm, defines, target, isDev)
-									resolved = true
-								}
-							}
-						}
+				/**
+				  exports: {
+				    "./lib/core": {
+				      "require": "./lib/core.js",
+				      "import": "./es/core.js"
+				    },
+				    "./lib/languages/*": {
+				      "require": "./lib/languages/*.js",
+				      "import": "./es/languages/*.js"
+				    }
+				  }
+				*/
+				sub := *npm
+				sub.Module = ""
+				sub.Main = ""
+				sub.Types = ""
+				// the `.js` extension of the submodule is trimmed by `parsePkg`
+				resolved := resolvePackageExports(&sub, "./"+pkg.Submodule, target, isDev, conditions) || resolvePackageExports(&sub, "./"+pkg.Submodule+".js", target, isDev, conditions)
+				if resolved {
+					if isBrowserTarget(target) {
+						resolveBrowserEntries(&sub, false)
 					}
-				}
-				if !resolved {
+					*npm = sub
+				} else {
 					if npm.Type == "module" || npm.Module != "" {
 						// follow main module type
 						npm.Module = pkg.Submodule
@@ -241,8 +221,12 @@ func initModule(wd string, pkg Pkg, target string, isDev bool) (esm *ModuleMeta,
 	return
 }
 
+// OldMeta defines the module meta of the previous build versions,
+// it contains the entry fields of the package.json.
 type OldMeta struct {
-	*NpmPackage
+	Main          string   `json:"main,omitempty"`
+	Module        string   `json:"module,omitempty"`
+	Types         string   `json:"types,omitempty"`
 	ExportDefault bool     `json:"exportDefault"`
 	Exports       []string `json:"exports"`
 	Dts           string   `json:"dts"`
@@ -287,6 +271,11 @@ func findModule(id string) (esm *ModuleMeta, err error) {
 	return
 }
 
+// storeModuleMeta stores the meta of the build
+func storeModuleMeta(id string, esm *ModuleMeta) error {
+	return db.Put(id, "build", storage.Store{"meta": string(utils.MustEncodeJSON(esm))})
+}
+
 func checkESM(wd string, packageName string, moduleSpecifier string) (resolveName string, exportDefault bool, err error) {
 	pkgDir := path.Join(wd, "node_modules", packageName)
 	if dirExists(path.Join(pkgDir, moduleSpecifier)) {
@@ -77,108 +77,67 @@ var builtInNodeModules = map[string]bool{
 	"zlib":                true,
 }
 
-// copy from https://github.com/webpack/webpack/blob/master/lib/ModuleNotFoundError.js#L13
-var polyfilledBuiltInNodeModules = map[string]string{
-	"assert":         "assert",
-	"buffer":         "buffer",
-	"console":        "console-browserify",
-	"constants":      "constants-browserify",
-	"crypto":         "crypto-browserify",
-	"domain":         "domain-browser",
-	"events":         "events",
-	"http":           "stream-http",
-	"https":          "https-browserify",
-	"os":             "os-browserify/browser",
-	"path":           "path-browserify",
-	"punycode":       "punycode",
-	"process":        "process/browser",
-	"querystring":    "querystring-es3",
-	"stream":         "stream-browserify",
-	"stream/web":     "web-streams-polyfill",
-	"string_decoder": "string_decoder",
-	"sys":            "util",
-	"timers":         "timers-browserify",
-	"tty":            "tty-browserify",
-	"url":            "url",
-	"util":           "util",
-	"vm":             "vm-browserify",
-	"zlib":           "browserify-zlib",
-}
-
-// status: https://deno.land/std/node
-var denoStdNodeModules = map[string]bool{
-	"assert":              true,
-	"assert/strict":       true,
-	"async_hooks":         true,
-	"buffer":              true,
-	"child_process":       true,
-	"cluster":             true,
-	"console":             true,
-	"constants":           true,
-	"crypto":              true,
-	"dgram":               true,
-	"diagnostics_channel": true,
-	"dns":                 true,
-	"domain":              true,
-	"events":              true,
-	"fs":                  true,
-	"fs/promises":         true,
-	"http":                true,
-	"http2":               true,
-	"https":               true,
-	"inspector":           true,
-	"module":              true,
-	"net":                 true,
-	"os":                  true,
-	"path":                true,
-	"path/posix":          true,
-	"path/win32":          true,
-	"perf_hooks":          true,
-	"punycode":            true,
-	"querystring":         true,
-	"readline":            true,
-	"repl":                true,
-	"stream":              true,
-	"stream/promises":     true,
-	"stream/web":          true,
-	"string_decoder":      true,
-	"sys":                 true,
-	"timers":              true,
-	"timers/promises":     true,
-	"tls":                 true,
-	"trace_events":        true,
-	"tty":                 true,
-	"url":                 true,
-	"util":                true,
-	"util/types":          true,
-	"v8":                  true,
-	"vm":                  true,
-	"wasi":                true,
-	"webcrypto":           true,
-	"worker_threads":      true,
-	"zlib":                true,
-}
-
 // NpmPackageVerions defines versions of a npm package
 type NpmPackageVerions struct {
 	DistTags map[string]string     `json:"dist-tags"`
 	Versions map[string]NpmPackage `json:"versions"`
+	Time     map[string]string     `json:"time"`
+}
+
+// isPublishedBefore checks whether the version was published before the given time,
+// a zero time means no limit.
+func (h *NpmPackageVerions) isPublishedBefore(version string, before time.Time) bool {
+	if before.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, h.Time[version])
+	return err == nil && !t.After(before)
 }
 
 // NpmPackage defines the package.json of npm
 type NpmPackage struct {
-	Name             string            `json:"name"`
-	Version          string            `json:"version"`
-	Main             string            `json:"main,omitempty"`
-	Module           string            `json:"module,omitempty"`
-	JsnextMain       string            `json:"jsnext:main,omitempty"`
-	Es2015           string            `json:"es2015,omitempty"`
-	Type             string            `json:"type,omitempty"`
-	Types            string            `json:"types,omitempty"`
-	Typings          string            `json:"typings,omitempty"`
-	Dependencies     map[string]string `json:"dependencies,omitempty"`
-	PeerDependencies map[string]string `json:"peerDependencies,omitempty"`
-	DefinedExports   interface{}       `json:"exports,omitempty"`
+	Name                 string                        `json:"name"`
+	Version              string                        `json:"version"`
+	Main                 string                        `json:"main,omitempty"`
+	Module               string                        `json:"module,omitempty"`
+	JsnextMain           string                        `json:"jsnext:main,omitempty"`
+	Es2015               string                        `json:"es2015,omitempty"`
+	Type                 string                        `json:"type,omitempty"`
+	Types                string                        `json:"types,omitempty"`
+	Typings              string                        `json:"typings,omitempty"`
+	Dependencies         map[string]string             `json:"dependencies,omitempty"`
+	PeerDependencies     map[string]string             `json:"peerDependencies,omitempty"`
+	PeerDependenciesMeta map[string]PeerDependencyMeta `json:"peerDependenciesMeta,omitempty"`
+	DefinedExports       interface{}                   `json:"exports,omitempty"`
+	DefinedImports       interface{}                   `json:"imports,omitempty"`
+	Browser              interface{}                   `json:"browser,omitempty"`
+	Deprecated           interface{}                   `json:"deprecated,omitempty"`
+}
+
+// UnmarshalJSON decodes the package.json, the objects in the `exports` and `imports` fields are
+// decoded as `*orderedMap` to keep the order of conditions.
+func (p *NpmPackage) UnmarshalJSON(data []byte) (err error) {
+	type npmPackage NpmPackage
+	var v struct {
+		npmPackage
+		Exports json.RawMessage `json:"exports,omitempty"`
+		Imports json.RawMessage `json:"imports,omitempty"`
+	}
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return
+	}
+	*p = NpmPackage(v.npmPackage)
+	if len(v.Exports) > 0 {
+		p.DefinedExports, err = decodeOrderedJSON(v.Exports)
+		if err != nil {
+			return
+		}
+	}
+	if len(v.Imports) > 0 {
+		p.DefinedImports, err = decodeOrderedJSON(v.Imports)
+	}
+	return
 }
 
 // Node defines the nodejs info
@@ -253,7 +212,7 @@ CheckYarn:
 	return
 }
 
-func getPackageInfo(wd string, name string, version string) (info NpmPackage, submodule string, fromPackageJSON bool, err error) {
+func getPackageInfo(wd string, name string, version string, before time.Time) (info NpmPackage, submodule string, fromPackageJSON bool, err error) {
 	slice := strings.Split(name, "/")
 	if l := len(slice); strings.HasPrefix(name, "@") && l > 1 {
 		name = strings.Join(slice[:2], "/")
@@ -287,19 +246,14 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackage, su
 		}
 	}
 
-	info, err = fetchPackageInfo(name, version)
+	info, err = fetchPackageInfo(name, version, before)
 	return
 }
 
 var lock sync.Map
 
-func fetchPackageInfo(name string, version string) (info NpmPackage, err error) {
-	if version == "" {
-		version = "latest"
-	}
-	id := fmt.Sprintf("npm:%s@%s", name, version)
-
-	// wait lock release
+// waitLock waits the lock of the id to be released
+func waitLock(id string) {
 	for {
 		_, ok := lock.Load(id)
 		if !ok {
@@ -307,10 +261,22 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		}
 		time.Sleep(10 * time.Millisecond)
 	}
+}
+
+// fetchPackageVersions fetches the packument of the package from the npm registry,
+// the packument is cached for 10 minutes.
+func fetchPackageVersions(name string) (h *NpmPackageVerions, err error) {
+	id := "npm:" + name
+
+	// wait lock release
+	waitLock(id)
 
 	data, err := cache.Get(id)
-	if err == nil && json.Unmarshal(data, &info) == nil {
-		return
+	if err == nil {
+		h = &NpmPackageVerions{}
+		if json.Unmarshal(data, h) == nil {
+			return
+		}
 	}
 	if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
 		log.Error("cache:", err)
@@ -327,7 +293,7 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 || resp.StatusCode == 401 {
-		err = fmt.Errorf("npm: package '%s' not found", name)
+		err = newServerError(ErrPackageNotFound, "npm: package '%s' not found", name)
 		return
 	}
 	if resp.StatusCode != 200 {
@@ -344,62 +310,174 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 		return
 	}
 
-	var h NpmPackageVerions
-	err = json.Unmarshal(data, &h)
+	h = &NpmPackageVerions{}
+	err = json.Unmarshal(data, h)
+	if err != nil {
+		return
+	}
+
+	log.Debugf("fetch packument(%s) in %v", name, time.Since(start))
+
+	// cache the parsed fields only
+	cache.Set(id, utils.MustEncodeJSON(h), 10*time.Minute)
+	return
+}
+
+// matchVersions returns the versions that match the constraint in ascending order, the prerelease
+// versions are ignored unless the constraint contains a prerelease version.
+func (h *NpmPackageVerions) matchVersions(constraint string, before time.Time) (vs []*semver.Version, err error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return
+	}
+	vs = make([]*semver.Version, 0, len(h.Versions))
+	for v := range h.Versions {
+		// ignore prerelease versions
+		if !strings.ContainsRune(constraint, '-') && strings.ContainsRune(v, '-') {
+			continue
+		}
+		if !h.isPublishedBefore(v, before) {
+			continue
+		}
+		// skip the malformed versions of the registry
+		ver, e := semver.NewVersion(v)
+		if e != nil {
+			continue
+		}
+		if c.Check(ver) {
+			vs = append(vs, ver)
+		}
+	}
+	sort.Sort(semver.Collection(vs))
+	return
+}
+
+// matchDistTag returns the newest version published before the given time on the release line
+// of the dist-tag version: the prerelease versions with the same identifier (like `beta`) for a
+// prerelease tag, or the stable versions of the same major for the others. The versions after the
+// tag version are ignored, an empty string is returned if there is no match.
+func (h *NpmPackageVerions) matchDistTag(distVersion string, before time.Time) (version string, err error) {
+	tv, err := semver.NewVersion(distVersion)
 	if err != nil {
 		return
 	}
+	line, _ := utils.SplitByFirstByte(tv.Prerelease(), '.')
+	var latest *semver.Version
+	for v := range h.Versions {
+		if !h.isPublishedBefore(v, before) {
+			continue
+		}
+		ver, e := semver.NewVersion(v)
+		if e != nil || ver.GreaterThan(tv) {
+			continue
+		}
+		if line != "" {
+			if l, _ := utils.SplitByFirstByte(ver.Prerelease(), '.'); l != line {
+				continue
+			}
+		} else if ver.Prerelease() != "" || ver.Major() != tv.Major() {
+			continue
+		}
+		if latest == nil || ver.GreaterThan(latest) {
+			latest = ver
+		}
+	}
+	if latest != nil {
+		version = latest.Original()
+	}
+	return
+}
+
+// resolveDistTag returns the version of the dist-tag at the given time: the tag version if it was
+// published before the time, otherwise the newest version of its release line, or the newest stable
+// version for the `latest` tag. An empty string is returned if there is no match.
+func (h *NpmPackageVerions) resolveDistTag(tag string, before time.Time) (version string, err error) {
+	distVersion, ok := h.DistTags[tag]
+	if !ok || h.isPublishedBefore(distVersion, before) {
+		return distVersion, nil
+	}
+	if tag != "latest" {
+		return h.matchDistTag(distVersion, before)
+	}
+	vs, err := h.matchVersions("*", before)
+	if err == nil && len(vs) > 0 {
+		version = vs[len(vs)-1].Original()
+	}
+	return
+}
 
+// fetchPackageInfo resolves the version from the npm registry, the versions published after
+// the `before` time are ignored if it's not zero.
+func fetchPackageInfo(name string, version string, before time.Time) (info NpmPackage, err error) {
+	if version == "" {
+		version = "latest"
+	}
 	isFullVersion := regFullVersion.MatchString(version)
+	if isFullVersion {
+		// an exact version is always resolved as it is
+		before = time.Time{}
+	}
+	id := fmt.Sprintf("npm:%s@%s", name, version)
+	if !before.IsZero() {
+		id += fmt.Sprintf("~%d", before.Unix())
+	}
+
+	// wait lock release
+	waitLock(id)
+
+	data, err := cache.Get(id)
+	if err == nil && json.Unmarshal(data, &info) == nil {
+		return
+	}
+	if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+		log.Error("cache:", err)
+	}
+
+	lock.Store(id, struct{}{})
+	defer lock.Delete(id)
+
+	h, err := fetchPackageVersions(name)
+	if err != nil {
+		return
+	}
+
 	if isFullVersion {
 		info = h.Versions[version]
+	} else if _, ok := h.DistTags[version]; ok {
+		var v string
+		v, err = h.resolveDistTag(version, before)
+		if err != nil {
+			return
+		}
+		if v != "" {
+			info = h.Versions[v]
+		}
 	} else {
-		distVersion, ok := h.DistTags[version]
-		if ok {
-			info = h.Versions[distVersion]
-		} else {
-			var c *semver.Constraints
-			c, err = semver.NewConstraint(version)
-			if err != nil && version != "latest" {
-				return fetchPackageInfo(name, "latest")
-			}
-			vs := make([]*semver.Version, len(h.Versions))
-			i := 0
-			for v := range h.Versions {
-				// ignore prerelease versions
-				if !strings.ContainsRune(version, '-') && strings.ContainsRune(v, '-') {
-					continue
-				}
-				var ver *semver.Version
-				ver, err = semver.NewVersion(v)
-				if err != nil {
-					return
-				}
-				if c.Check(ver) {
-					vs[i] = ver
-					i++
-				}
-			}
-			if i > 0 {
-				vs = vs[:i]
-				if i > 1 {
-					sort.Sort(semver.Collection(vs))
-				}
-				info = h.Versions[vs[i-1].String()]
-			}
+		if _, e := semver.NewConstraint(version); e != nil && version != "latest" {
+			return fetchPackageInfo(name, "latest", before)
+		}
+		var vs []*semver.Version
+		vs, err = h.matchVersions(version, before)
+		if err != nil {
+			return
+		}
+		if len(vs) > 0 {
+			info = h.Versions[vs[len(vs)-1].Original()]
 		}
 	}
 
 	if info.Version == "" {
-		err = fmt.Errorf("npm: version '%s' not found", version)
+		if !before.IsZero() {
+			err = newServerError(ErrVersionNotFound, "npm: version '%s' not found before %s", version, before.UTC().Format(time.RFC3339))
+		} else {
+			err = newServerError(ErrVersionNotFound, "npm: version '%s' not found", version)
+		}
 		return
 	}
 
-	log.Debugf("lookup package(%s@%s) in %v", name, info.Version, time.Since(start))
-
 	// cache data
 	var ttl time.Duration = 0
-	if !isFullVersion {
+	if !isFullVersion && (before.IsZero() || before.After(time.Now())) {
 		ttl = 10 * time.Minute
 	}
 	cache.Set(id, utils.MustEncodeJSON(info), ttl)
@@ -418,100 +496,15 @@ func getNodejsVersion() (version string, major int, err error) {
 	return
 }
 
-// see https://nodejs.org/api/packages.html
-func resolvePackageExports(p *NpmPackage, exports interface{}, target string, isDev bool) {
-	s, ok := exports.(string)
-	if ok {
-		if p.Type == "module" {
-			p.Module = s
-		} else {
-			p.Main = s
-		}
-		return
-	}
-
-	m, ok := exports.(map[string]interface{})
-	if ok {
-		names := []string{"es2015", "module", "import", "browser", "worker"}
-		if target == "deno" {
-			names = []string{"deno", "es2015", "module", "import", "worker", "browser"}
-		}
-		if p.Type == "module" {
-			if isDev {
-				names = append(names, "development", "default")
-			} else {
-				names = append(names, "production", "default")
-			}
-		}
-		for _, name := range names {
-			value, ok := m[name]
-			if ok {
-				s, ok := value.(string)
-				if ok && s != "" {
-					p.Module = s
-					break
-				}
-			}
-		}
-		for _, name := range []string{"require", "node", "default"} {
-			value, ok := m[name]
-			if ok {
-				s, ok := value.(string)
-				if ok && s != "" {
-					p.Main = s
-					break
-				}
-			}
-		}
-		for key, value := range m {
-			s, ok := value.(string)
-			if ok && s != "" {
-				switch key {
-				case "types":
-					p.Types = s
-				case "typings":
-					p.Typings = s
-				}
-			}
-		}
-	}
-}
-
-func fixNpmPackage(p NpmPackage, target string, isDev bool) *NpmPackage {
-	exports := p.DefinedExports
+func fixNpmPackage(p NpmPackage, target string, isDev bool, conditions []string) *NpmPackage {
 	np := &p
 
-	if exports != nil {
-		if m, ok := exports.(map[string]interface{}); ok {
-			v, ok := m["."]
-			if ok {
-				/*
-					exports: {
-						".": {
-							"require": "./cjs/index.js",
-							"import": "./esm/index.js"
-						}
-					}
-					exports: {
-						".": "./esm/index.js"
-					}
-				*/
-				resolvePackageExports(np, v, target, isDev)
-			} else {
-				/*
-					exports: {
-						"require": "./cjs/index.js",
-						"import": "./esm/index.js"
-					}
-				*/
-				resolvePackageExports(np, m, target, isDev)
-			}
-		} else if _, ok := exports.(string); ok {
-			/*
-			  exports: "./esm/index.js"
-			*/
-			resolvePackageExports(np, exports, target, isDev)
-		}
+	// resolve the main export of the `exports` field
+	resolved := resolvePackageExports(np, ".", target, isDev, conditions)
+
+	// use the browser version of the entries for browser targets
+	if isBrowserTarget(target) {
+		resolveBrowserEntries(np, !resolved)
 	}
 
 	if p.Module == "" {
@@ -570,6 +563,12 @@ func installNodejs(dir string, version string) (err error) {
 }
 
 func yarnAdd(wd string, packages ...string) (err error) {
+	_, err = runYarnAdd(wd, packages...)
+	return
+}
+
+// runYarnAdd runs `yarn add` in the working directory and returns the output of the command
+func runYarnAdd(wd string, packages ...string) (output []byte, err error) {
 	if len(packages) > 0 {
 		start := time.Now()
 		args := []string{
@@ -598,15 +597,174 @@ func yarnAdd(wd string, packages ...string) (err error) {
 		}
 		cmd := exec.Command("yarn", append(args, packages...)...)
 		cmd.Dir = wd
-		output, err := cmd.CombinedOutput()
+		output, err = cmd.CombinedOutput()
 		if err != nil {
-			return fmt.Errorf("yarn add %s: %s", strings.Join(packages, ","), string(output))
+			err = fmt.Errorf("yarn add %s: %s", strings.Join(packages, ","), string(output))
+			return
 		}
 		log.Debug("yarn add", strings.Join(packages, ","), "in", time.Since(start))
 	}
 	return
 }
 
+// yarnEdge is a dependency of a package in the dependency tree
+type yarnEdge struct {
+	parent  string
+	name    string
+	version string
+}
+
+// pinYarnResolutions resolves the dependency tree of the package with the versions published
+// before the given time, and writes them to the `resolutions` field of the package.json in
+// the working directory, that makes yarn install the same tree at any time.
+// see https://classic.yarnpkg.com/en/docs/selective-version-resolutions
+func pinYarnResolutions(wd string, name string, version string, before time.Time) (err error) {
+	edges := []yarnEdge{}
+	resolved := map[string]NpmPackage{}
+	queue := []yarnEdge{{"", name, version}}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		key := e.name + "@" + e.version
+		info, ok := resolved[key]
+		if !ok {
+			info, err = fetchPackageInfo(e.name, e.version, before)
+			if err != nil {
+				return
+			}
+			resolved[key] = info
+			for depName, depVersion := range info.Dependencies {
+				// skip the non-registry specifiers like git urls
+				if strings.ContainsAny(depVersion, ":/") {
+					continue
+				}
+				queue = append(queue, yarnEdge{info.Name, depName, depVersion})
+			}
+		}
+		if e.parent != "" {
+			edges = append(edges, yarnEdge{e.parent, e.name, info.Version})
+		}
+	}
+
+	resolutions := toYarnResolutions(edges)
+	if len(resolutions) == 0 {
+		return
+	}
+	return writeYarnResolutions(wd, resolutions)
+}
+
+// toYarnResolutions returns the `resolutions` of the dependency edges, a package that is resolved
+// to different versions is pinned per parent.
+func toYarnResolutions(edges []yarnEdge) map[string]string {
+	versions := map[string]map[string]bool{}
+	for _, e := range edges {
+		if versions[e.name] == nil {
+			versions[e.name] = map[string]bool{}
+		}
+		versions[e.name][e.version] = true
+	}
+	resolutions := map[string]string{}
+	for _, e := range edges {
+		if len(versions[e.name]) == 1 {
+			resolutions["**/"+e.name] = e.version
+		} else {
+			resolutions[fmt.Sprintf("**/%s/%s", e.parent, e.name)] = e.version
+		}
+	}
+	return resolutions
+}
+
+// writeYarnResolutions writes the resolutions to the package.json of the working directory,
+// the given resolutions take precedence over the existing ones.
+func writeYarnResolutions(wd string, resolutions map[string]string) (err error) {
+	pkgJson := map[string]interface{}{}
+	pkgJsonPath := path.Join(wd, "package.json")
+	if fileExists(pkgJsonPath) {
+		err = utils.ParseJSONFile(pkgJsonPath, &pkgJson)
+		if err != nil {
+			return
+		}
+	}
+	m, ok := pkgJson["resolutions"].(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+	}
+	for k, v := range resolutions {
+		m[k] = v
+	}
+	pkgJson["resolutions"] = m
+	return ioutil.WriteFile(pkgJsonPath, utils.MustEncodeJSON(pkgJson), 0644)
+}
+
+// readInstalledDependencies walks the node_modules of the working directory and returns the
+// dependency edges of the installed packages, a dependency is looked up in the node_modules
+// of the package first and then in the node_modules of its ancestors like node does.
+func readInstalledDependencies(wd string) (edges []yarnEdge, err error) {
+	var walk func(dir string, lookup []string) error
+	walk = func(dir string, lookup []string) error {
+		nmDir := path.Join(dir, "node_modules")
+		names, err := readNodeModules(nmDir)
+		if err != nil {
+			return err
+		}
+		lookup = append([]string{nmDir}, lookup...)
+		for _, name := range names {
+			pkgDir := path.Join(nmDir, name)
+			var p NpmPackage
+			if utils.ParseJSONFile(path.Join(pkgDir, "package.json"), &p) != nil {
+				continue
+			}
+			depLookup := append([]string{path.Join(pkgDir, "node_modules")}, lookup...)
+			for depName := range p.Dependencies {
+				for _, d := range depLookup {
+					var dep NpmPackage
+					if utils.ParseJSONFile(path.Join(d, depName, "package.json"), &dep) == nil {
+						edges = append(edges, yarnEdge{p.Name, depName, dep.Version})
+						break
+					}
+				}
+			}
+			if err := walk(pkgDir, lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(wd, nil)
+	return
+}
+
+// readNodeModules returns the names of the packages in the node_modules directory
+func readNodeModules(nmDir string) (names []string, err error) {
+	entries, err := ioutil.ReadDir(nmDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, "@") {
+			scoped, e := ioutil.ReadDir(path.Join(nmDir, name))
+			if e != nil {
+				return nil, e
+			}
+			for _, s := range scoped {
+				if s.IsDir() && !strings.HasPrefix(s.Name(), ".") {
+					names = append(names, name+"/"+s.Name())
+				}
+			}
+		} else {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
 func yarnCacheClean(wd string, packages ...string) {
 	if len(packages) > 0 {
 		args := []string{"cache", "clean"}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMatchVersions(t *testing.T) {
+	h := &NpmPackageVerions{
+		DistTags: map[string]string{"latest": "1.1.0", "next": "2.0.0-beta.1"},
+		Versions: map[string]NpmPackage{
+			"1.0.0":        {Version: "1.0.0"},
+			"1.1.0":        {Version: "1.1.0"},
+			"2.0.0-beta.1": {Version: "2.0.0-beta.1"},
+		},
+		Time: map[string]string{
+			"1.0.0":        "2022-01-01T00:00:00.000Z",
+			"1.1.0":        "2022-08-01T00:00:00.000Z",
+			"2.0.0-beta.1": "2022-09-01T00:00:00.000Z",
+		},
+	}
+
+	vs, err := h.matchVersions("*", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[1].Original() != "1.1.0" {
+		t.Fatalf("prerelease versions should be ignored, got %v", vs)
+	}
+
+	vs, err = h.matchVersions(">=2.0.0-0", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].Original() != "2.0.0-beta.1" {
+		t.Fatalf("prerelease range should match prerelease versions, got %v", vs)
+	}
+
+	vs, err = h.matchVersions("^1", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 1 || vs[0].Original() != "1.0.0" {
+		t.Fatalf("versions published after the before time should be ignored, got %v", vs)
+	}
+}
+
+func TestMatchDistTag(t *testing.T) {
+	h := &NpmPackageVerions{
+		Versions: map[string]NpmPackage{
+			"1.0.0":         {Version: "1.0.0"},
+			"1.1.0":         {Version: "1.1.0"},
+			"2.0.0-alpha.1": {Version: "2.0.0-alpha.1"},
+			"2.0.0-beta.0":  {Version: "2.0.0-beta.0"},
+			"2.0.0-beta.1":  {Version: "2.0.0-beta.1"},
+			"2.0.0":         {Version: "2.0.0"},
+		},
+		Time: map[string]string{
+			"1.0.0":         "2022-01-01T00:00:00.000Z",
+			"1.1.0":         "2022-08-01T00:00:00.000Z",
+			"2.0.0-alpha.1": "2022-08-10T00:00:00.000Z",
+			"2.0.0-beta.0":  "2022-08-15T00:00:00.000Z",
+			"2.0.0-beta.1":  "2022-09-01T00:00:00.000Z",
+			"2.0.0":         "2022-10-01T00:00:00.000Z",
+		},
+	}
+
+	for _, c := range []struct {
+		tag      string
+		before   time.Time
+		expected string
+	}{
+		{"2.0.0-beta.1", time.Date(2022, 8, 20, 0, 0, 0, 0, time.UTC), "2.0.0-beta.0"},
+		{"2.0.0-beta.1", time.Date(2022, 8, 12, 0, 0, 0, 0, time.UTC), ""},
+		{"2.0.0", time.Date(2022, 9, 10, 0, 0, 0, 0, time.UTC), ""},
+		{"1.1.0", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), "1.0.0"},
+	} {
+		v, err := h.matchDistTag(c.tag, c.before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Fatalf("bad version of the tag %s before %v: %s, expected %s", c.tag, c.before, v, c.expected)
+		}
+	}
+}
+
+func TestReadInstalledDependencies(t *testing.T) {
+	wd := t.TempDir()
+	packages := map[string]string{
+		"node_modules/a":                `{"name":"a","version":"1.0.0","dependencies":{"c":"^1.0.0","@s/d":"^1.0.0"}}`,
+		"node_modules/b":                `{"name":"b","version":"1.0.0","dependencies":{"c":"^2.0.0"}}`,
+		"node_modules/b/node_modules/c": `{"name":"c","version":"2.1.0"}`,
+		"node_modules/c":                `{"name":"c","version":"1.2.0","dependencies":{"missing":"*"}}`,
+		"node_modules/@s/d":             `{"name":"@s/d","version":"1.0.1"}`,
+	}
+	for dir, pkgJson := range packages {
+		ensureDir(path.Join(wd, dir))
+		if err := ioutil.WriteFile(path.Join(wd, dir, "package.json"), []byte(pkgJson), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edges, err := readInstalledDependencies(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolutions := toYarnResolutions(edges)
+	expected := map[string]string{"**/a/c": "1.2.0", "**/b/c": "2.1.0", "**/@s/d": "1.0.1"}
+	if len(resolutions) != len(expected) {
+		t.Fatalf("bad resolutions: %v", resolutions)
+	}
+	for k, v := range expected {
+		if resolutions[k] != v {
+			t.Fatalf("bad resolutions: %v", resolutions)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// PackageOverride defines the operator-managed fixes of the packages that match the name and
+// version range, the fields of package.json are replaced and the patches are applied in order.
+type PackageOverride struct {
+	Name    string
+	Range   string
+	Fields  *orderedMap
+	Patches []string
+
+	constraint *semver.Constraints
+	hash       string
+}
+
+// the `overrides.json` manifest in the overrides dir:
+//
+//	{
+//	  "name@range": {
+//	    "packageJson": { "module": "./esm/index.js", "sideEffects": false },
+//	    "patches": ["name-fix-browser.patch"]
+//	  }
+//	}
+type overridesManifest map[string]struct {
+	PackageJSON json.RawMessage `json:"packageJson"`
+	Patches     []string        `json:"patches"`
+}
+
+var overrides struct {
+	lock sync.RWMutex
+	list []*PackageOverride
+}
+
+// loadOverrides loads the overrides from the `overrides.json` manifest of the dir,
+// no overrides are loaded if the manifest doesn't exist.
+func loadOverrides(dir string) (list []*PackageOverride, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "overrides.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var manifest overridesManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("bad overrides manifest: %v", err)
+	}
+
+	for key, entry := range manifest {
+		name, versionRange := key, "*"
+		if i := strings.LastIndexByte(key, '@'); i > 0 {
+			name, versionRange = key[:i], key[i+1:]
+		}
+		_, _, _, err = splitPkgPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("bad override '%s': %v", key, err)
+		}
+		o := &PackageOverride{Name: name, Range: versionRange}
+		o.constraint, err = semver.NewConstraint(versionRange)
+		if err != nil {
+			return nil, fmt.Errorf("bad override '%s': invalid version range", key)
+		}
+		hasher := sha1.New()
+		fmt.Fprintf(hasher, "%s@%s\n", name, versionRange)
+		if len(entry.PackageJSON) > 0 {
+			var v interface{}
+			v, err = decodeOrderedJSON(entry.PackageJSON)
+			if err != nil {
+				return nil, fmt.Errorf("bad override '%s': %v", key, err)
+			}
+			fields, ok := v.(*orderedMap)
+			if !ok {
+				return nil, fmt.Errorf("bad override '%s': `packageJson` must be an object", key)
+			}
+			o.Fields = fields
+			hasher.Write(entry.PackageJSON)
+		}
+		for _, name := range entry.Patches {
+			filename := path.Join(dir, name)
+			var patch []byte
+			patch, err = ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, fmt.Errorf("bad override '%s': %v", key, err)
+			}
+			o.Patches = append(o.Patches, filename)
+			hasher.Write(patch)
+		}
+		o.hash = hex.EncodeToString(hasher.Sum(nil))
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name+"@"+list[i].Range < list[j].Name+"@"+list[j].Range
+	})
+	return
+}
+
+// reloadOverrides reloads the overrides of the dir, the current overrides are kept if
+// the manifest is invalid.
+func reloadOverrides(dir string) {
+	list, err := loadOverrides(dir)
+	if err != nil {
+		log.Errorf("load overrides: %v", err)
+		return
+	}
+	setOverrides(list)
+}
+
+// setOverrides replaces the current overrides
+func setOverrides(list []*PackageOverride) {
+	overrides.lock.Lock()
+	overrides.list = list
+	overrides.lock.Unlock()
+}
+
+// findOverrides returns the overrides of the package version
+func findOverrides(name string, version string) (list []*PackageOverride) {
+	overrides.lock.RLock()
+	defer overrides.lock.RUnlock()
+
+	var v *semver.Version
+	for _, o := range overrides.list {
+		if o.Name != name {
+			continue
+		}
+		if v == nil {
+			var err error
+			v, err = semver.NewVersion(version)
+			if err != nil {
+				return
+			}
+		}
+		if o.constraint.Check(v) {
+			list = append(list, o)
+		}
+	}
+	return
+}
+
+// getOverridesID returns the identity of the overrides that are applied to the package version,
+// or the identity of all overrides if the name is empty. An empty string is returned if there
+// are no overrides.
+func getOverridesID(name string, version string) string {
+	var list []*PackageOverride
+	if name != "" {
+		list = findOverrides(name, version)
+	} else {
+		overrides.lock.RLock()
+		list = overrides.list
+		overrides.lock.RUnlock()
+	}
+	if len(list) == 0 {
+		return ""
+	}
+	hasher := sha1.New()
+	for _, o := range list {
+		hasher.Write([]byte(o.hash))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))[:8]
+}
+
+// applyOverrides applies the overrides of the package version to the installed package
+func applyOverrides(wd string, name string, version string) (err error) {
+	for _, o := range findOverrides(name, version) {
+		err = o.apply(path.Join(wd, "node_modules", name))
+		if err != nil {
+			return fmt.Errorf("override '%s@%s': %v", o.Name, o.Range, err)
+		}
+		log.Debugf("override '%s@%s' applied to %s@%s", o.Name, o.Range, name, version)
+	}
+	return
+}
+
+// applyInstalledOverrides applies the overrides to all matched packages installed in the wd
+func applyInstalledOverrides(wd string) (err error) {
+	overrides.lock.RLock()
+	names := map[string]bool{}
+	for _, o := range overrides.list {
+		names[o.Name] = true
+	}
+	overrides.lock.RUnlock()
+
+	for name := range names {
+		var p NpmPackage
+		data, e := ioutil.ReadFile(path.Join(wd, "node_modules", name, "package.json"))
+		if e != nil || json.Unmarshal(data, &p) != nil {
+			continue
+		}
+		err = applyOverrides(wd, name, p.Version)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (o *PackageOverride) apply(pkgDir string) (err error) {
+	for _, filename := range o.Patches {
+		var output []byte
+		output, err = exec.Command("patch", "-p1", "--batch", "--forward", "-d", pkgDir, "-i", filename).CombinedOutput()
+		if err != nil {
+			msg := strings.TrimSpace(string(output))
+			if msg == "" {
+				msg = err.Error()
+			}
+			return fmt.Errorf("patch %s: %s", path.Base(filename), msg)
+		}
+	}
+
+	if o.Fields != nil {
+		packageFile := path.Join(pkgDir, "package.json")
+		var data []byte
+		data, err = ioutil.ReadFile(packageFile)
+		if err != nil {
+			return
+		}
+		var v interface{}
+		v, err = decodeOrderedJSON(data)
+		if err != nil {
+			return
+		}
+		pkg, ok := v.(*orderedMap)
+		if !ok {
+			return errors.New("bad package.json")
+		}
+		for _, key := range o.Fields.Keys() {
+			value, _ := o.Fields.Get(key)
+			pkg.Set(key, value)
+		}
+		data, err = pkg.MarshalJSON()
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(packageFile, data, 0644)
+	}
+	return
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esm-overrides-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := `{
+		"broken@<1.2.0": {
+			"packageJson": {"module": "./esm/index.js", "sideEffects": false},
+			"patches": ["broken.patch"]
+		},
+		"@scope/other": {"packageJson": {"browser": false}}
+	}`
+	patch := "--- a/index.js\n+++ b/index.js\n@@ -1 +1 @@\n-module.exports = require('fs')\n+module.exports = {}\n"
+	ioutil.WriteFile(path.Join(dir, "overrides.json"), []byte(manifest), 0644)
+	ioutil.WriteFile(path.Join(dir, "broken.patch"), []byte(patch), 0644)
+
+	list, err := loadOverrides(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "@scope/other" || list[0].Range != "*" || list[1].Name != "broken" || list[1].Range != "<1.2.0" {
+		t.Fatalf("bad overrides: %v", list)
+	}
+
+	saved := overrides.list
+	setOverrides(list)
+	defer setOverrides(saved)
+
+	if len(findOverrides("broken", "1.1.0")) != 1 || len(findOverrides("broken", "1.2.0")) != 0 {
+		t.Fatal("bad version range matching")
+	}
+	id := getOverridesID("broken", "1.1.0")
+	if id == "" || getOverridesID("broken", "1.2.0") != "" || getOverridesID("", "") == id {
+		t.Fatal("bad overrides ID")
+	}
+
+	// the import path of a bundle build carries the same overrides ID as the build
+	for _, bundleMode := range []bool{false, true} {
+		task := &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "broken", Version: "1.1.0"}, Target: "es2022", BundleMode: bundleMode}
+		importPath := task.getImportPath(task.Pkg, "", bundleMode)
+		if !strings.HasSuffix(importPath, "/"+task.ID()) {
+			t.Fatalf("the import path %s doesn't match the build ID %s", importPath, task.ID())
+		}
+	}
+
+	pkgDir := path.Join(dir, "node_modules", "broken")
+	os.MkdirAll(pkgDir, 0755)
+	ioutil.WriteFile(path.Join(pkgDir, "package.json"), []byte(`{"name":"broken","version":"1.1.0","main":"./index.js","exports":{"import":"./esm/index.js","require":"./index.js"}}`), 0644)
+	ioutil.WriteFile(path.Join(pkgDir, "index.js"), []byte("module.exports = require('fs')\n"), 0644)
+
+	err = list[1].apply(pkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path.Join(pkgDir, "index.js"))
+	if string(data) != "module.exports = {}\n" {
+		t.Fatalf("bad patched file: %s", data)
+	}
+	data, _ = ioutil.ReadFile(path.Join(pkgDir, "package.json"))
+	if !strings.Contains(string(data), `"exports":{"import":"./esm/index.js","require":"./index.js"},"module":"./esm/index.js","sideEffects":false`) {
+		t.Fatalf("bad package.json: %s", data)
+	}
+}
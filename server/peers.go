@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/gox/utils"
+)
+
+// PeerDependencyMeta defines the entry of the `peerDependenciesMeta` field of package.json
+type PeerDependencyMeta struct {
+	Optional bool `json:"optional"`
+}
+
+// isOptionalPeer checks whether the module is an optional peer dependency of the package that
+// is not a regular dependency at the same time
+func isOptionalPeer(npm *NpmPackage, name string) bool {
+	if _, ok := npm.PeerDependencies[name]; !ok {
+		return false
+	}
+	if _, ok := npm.Dependencies[name]; ok {
+		return false
+	}
+	return npm.PeerDependenciesMeta[name].Optional
+}
+
+// getOptionalPeerStub returns the stub of the missing optional peer dependency, importing the
+// stub is fine while using any of its exports throws.
+func getOptionalPeerStub(name string, importer string) string {
+	message := fmt.Sprintf(
+		"[esm.sh] The optional peer dependency \"%s\" of \"%s\" is not provided, add it to the `?deps` query to use it.",
+		name,
+		importer,
+	)
+	return fmt.Sprintf(`const fail = () => { throw new Error(%q) };
+module.exports = new Proxy(() => {}, {
+  get: (_, key) => key === "__esModule" || key === "then" || typeof key === "symbol" ? undefined : fail(),
+  apply: fail,
+  construct: fail,
+});
+`, message)
+}
+
+// getUserDeps returns the deps of the `?deps` query without the implicit deps that are added to every lib.
+// Since the versions of react are forced, an explicit `?deps=react-dom` can't be told apart from the implicit one.
+func getUserDeps(deps PkgSlice) PkgSlice {
+	userDeps := PkgSlice{}
+	for _, dep := range deps {
+		implicit := false
+		for _, p := range implicitDeps {
+			if name, version := utils.SplitByLastByte(p, '@'); dep.Name == name && dep.Version == version {
+				implicit = true
+				break
+			}
+		}
+		if !implicit {
+			userDeps = append(userDeps, dep)
+		}
+	}
+	return userDeps
+}
+
+// checkPeerDependencies returns the warnings of the `?deps` versions that don't satisfy the
+// peer dependency ranges of the package
+func checkPeerDependencies(npm *NpmPackage, deps PkgSlice) (warnings []string) {
+	for _, dep := range deps {
+		versionRange, ok := npm.PeerDependencies[dep.Name]
+		if !ok {
+			continue
+		}
+		c, err := semver.NewConstraint(versionRange)
+		if err != nil {
+			continue
+		}
+		v, err := semver.NewVersion(dep.Version)
+		if err != nil {
+			continue
+		}
+		if !c.Check(v) {
+			warnings = append(warnings, fmt.Sprintf(
+				"peer dependency '%s@%s' of '%s@%s' is not satisfied by '%s'",
+				dep.Name,
+				versionRange,
+				npm.Name,
+				npm.Version,
+				dep.Version,
+			))
+		}
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerDependencies(t *testing.T) {
+	p := parseTestPackage(t, `{
+		"name": "react-lib",
+		"version": "1.0.0",
+		"dependencies": {"tslib": "^2.0.0"},
+		"peerDependencies": {"react": "^17.0.0 || ^18.0.0", "react-dom": "^18.0.0", "tslib": "^2.0.0"},
+		"peerDependenciesMeta": {"react-dom": {"optional": true}, "tslib": {"optional": true}}
+	}`)
+
+	if isOptionalPeer(&p, "react") || !isOptionalPeer(&p, "react-dom") || isOptionalPeer(&p, "tslib") {
+		t.Fatal("bad optional peer dependencies")
+	}
+
+	warnings := checkPeerDependencies(&p, PkgSlice{
+		{Name: "react", Version: "16.14.0"},
+		{Name: "react-dom", Version: "18.2.0"},
+		{Name: "lodash", Version: "4.17.21"},
+	})
+	if len(warnings) != 1 || warnings[0] != "peer dependency 'react@^17.0.0 || ^18.0.0' of 'react-lib@1.0.0' is not satisfied by '16.14.0'" {
+		t.Fatalf("bad warnings: %v", warnings)
+	}
+}
+
+func TestGetUserDeps(t *testing.T) {
+	deps, err := parseDepsQuery("lodash@4.17.21", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userDeps := getUserDeps(deps)
+	if len(userDeps) != 1 || userDeps[0].Name != "lodash" {
+		t.Fatalf("bad user deps: %v", userDeps)
+	}
+}
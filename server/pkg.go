@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ije/gox/utils"
 )
@@ -13,33 +14,10 @@ type Pkg struct {
 	Submodule string `json:"submodule"`
 }
 
-func parsePkg(pathname string) (*Pkg, bool, error) {
-	a := strings.Split(strings.Trim(pathname, "/"), "/")
-	for i, s := range a {
-		a[i] = strings.TrimSpace(s)
-	}
-	scope := ""
-	packageName := a[0]
-	submodule := strings.Join(a[1:], "/")
-	if strings.HasPrefix(packageName, "@") && len(a) > 1 {
-		scope = packageName[1:]
-		packageName = a[1]
-		submodule = strings.Join(a[2:], "/")
-	}
-
-	// ref https://github.com/npm/validate-npm-package-name
-	if scope != "" && (len(scope) > 214 || !npmNaming.Is(scope)) {
-		return nil, false, fmt.Errorf("invalid scope '%s'", scope)
-	}
-
-	name, version := utils.SplitByLastByte(packageName, '@')
-
-	if name != "" && (len(name) > 214 || !npmNaming.Is(name)) {
-		return nil, false, fmt.Errorf("invalid package name '%s'", name)
-	}
-
-	if scope != "" {
-		name = fmt.Sprintf("@%s/%s", scope, name)
+func parsePkg(pathname string, before time.Time) (*Pkg, bool, error) {
+	name, version, submodule, err := splitPkgPath(pathname)
+	if err != nil {
+		return nil, false, err
 	}
 
 	// force react to use single version
@@ -61,7 +39,7 @@ func parsePkg(pathname string) (*Pkg, bool, error) {
 		}, true, nil
 	}
 
-	info, _, _, err := getPackageInfo("", name, version)
+	info, _, _, err := getPackageInfo("", name, version, before)
 	if err != nil {
 		return nil, false, err
 	}
@@ -73,6 +51,40 @@ func parsePkg(pathname string) (*Pkg, bool, error) {
 	}, false, nil
 }
 
+// splitPkgPath splits the pathname like `/@scope/name@version/submodule` and validates the package name
+func splitPkgPath(pathname string) (name string, version string, submodule string, err error) {
+	a := strings.Split(strings.Trim(pathname, "/"), "/")
+	for i, s := range a {
+		a[i] = strings.TrimSpace(s)
+	}
+	scope := ""
+	packageName := a[0]
+	submodule = strings.Join(a[1:], "/")
+	if strings.HasPrefix(packageName, "@") && len(a) > 1 {
+		scope = packageName[1:]
+		packageName = a[1]
+		submodule = strings.Join(a[2:], "/")
+	}
+
+	// ref https://github.com/npm/validate-npm-package-name
+	if scope != "" && (len(scope) > 214 || !npmNaming.Is(scope)) {
+		err = newServerError(ErrBadRequest, "invalid scope '%s'", scope)
+		return
+	}
+
+	name, version = utils.SplitByLastByte(packageName, '@')
+
+	if name != "" && (len(name) > 214 || !npmNaming.Is(name)) {
+		err = newServerError(ErrBadRequest, "invalid package name '%s'", name)
+		return
+	}
+
+	if scope != "" {
+		name = fmt.Sprintf("@%s/%s", scope, name)
+	}
+	return
+}
+
 func (m Pkg) Equels(other Pkg) bool {
 	return m.Name == other.Name && m.Version == other.Version && m.Submodule == other.Submodule
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// BuildInfo describes the build that a plugin runs for
+type BuildInfo struct {
+	Package    string
+	Version    string
+	Submodule  string
+	Target     string
+	Dev        bool
+	Bundle     bool
+	Conditions []string
+}
+
+// BuildPlugin defines a plugin that runs for all builds, the hooks are optional.
+type BuildPlugin struct {
+	// Name and Version identify the plugin, they are folded into the build ID so the
+	// builds are not shared with the servers that don't use the same plugins.
+	Name    string
+	Version string
+	// Esbuild returns an esbuild plugin for the build, the plugins run before the
+	// built-in resolver, return nil to skip.
+	Esbuild func(info BuildInfo) *api.Plugin
+	// Resolve rewrites the import specifier before the built-in resolution, a `http(s)://`
+	// URL is kept as an external import. Return false to leave the specifier unchanged.
+	Resolve func(info BuildInfo, specifier string, importer string) (string, bool)
+	// Transform transforms the JS output of the build
+	Transform func(info BuildInfo, code []byte) ([]byte, error)
+}
+
+var buildPlugins struct {
+	lock sync.RWMutex
+	list []BuildPlugin
+	id   string
+}
+
+// RegisterBuildPlugin registers a plugin for all builds, it should be called before `Serve`.
+func RegisterBuildPlugin(plugin BuildPlugin) error {
+	if plugin.Name == "" {
+		return errors.New("plugin name is required")
+	}
+	if plugin.Esbuild == nil && plugin.Resolve == nil && plugin.Transform == nil {
+		return fmt.Errorf("plugin '%s' has no hooks", plugin.Name)
+	}
+
+	buildPlugins.lock.Lock()
+	defer buildPlugins.lock.Unlock()
+
+	for _, p := range buildPlugins.list {
+		if p.Name == plugin.Name {
+			return fmt.Errorf("plugin '%s' is already registered", plugin.Name)
+		}
+	}
+	buildPlugins.list = append(buildPlugins.list, plugin)
+
+	ids := make([]string, len(buildPlugins.list))
+	for i, p := range buildPlugins.list {
+		ids[i] = p.Name + "@" + p.Version
+	}
+	sort.Strings(ids)
+	hasher := sha1.New()
+	hasher.Write([]byte(strings.Join(ids, "\n")))
+	buildPlugins.id = hex.EncodeToString(hasher.Sum(nil))[:8]
+	return nil
+}
+
+// getBuildPlugins returns the registered plugins
+func getBuildPlugins() []BuildPlugin {
+	buildPlugins.lock.RLock()
+	defer buildPlugins.lock.RUnlock()
+
+	return buildPlugins.list
+}
+
+// getBuildPluginsID returns the identity of the registered plugins, or an empty string
+// if there are no plugins.
+func getBuildPluginsID() string {
+	buildPlugins.lock.RLock()
+	defer buildPlugins.lock.RUnlock()
+
+	return buildPlugins.id
+}
+
+func (task *BuildTask) getBuildInfo() BuildInfo {
+	return BuildInfo{
+		Package:    task.Pkg.Name,
+		Version:    task.Pkg.Version,
+		Submodule:  task.Pkg.Submodule,
+		Target:     task.Target,
+		Dev:        task.DevMode,
+		Bundle:     task.BundleMode || len(task.Entries) > 0,
+		Conditions: task.Conditions,
+	}
+}
+
+// getEsbuildPlugins returns the esbuild plugins of the registered plugins
+func (task *BuildTask) getEsbuildPlugins() []api.Plugin {
+	plugins := []api.Plugin{}
+	info := task.getBuildInfo()
+	for _, p := range getBuildPlugins() {
+		if p.Esbuild != nil {
+			if plugin := p.Esbuild(info); plugin != nil {
+				plugins = append(plugins, *plugin)
+			}
+		}
+	}
+	return plugins
+}
+
+// resolveWithPlugins applies the resolution hooks of the registered plugins in order
+func (task *BuildTask) resolveWithPlugins(specifier string, importer string) string {
+	plugins := getBuildPlugins()
+	if len(plugins) == 0 {
+		return specifier
+	}
+	info := task.getBuildInfo()
+	for _, p := range plugins {
+		if p.Resolve != nil {
+			if resolved, ok := p.Resolve(info, specifier, importer); ok && resolved != "" {
+				specifier = resolved
+			}
+		}
+	}
+	return specifier
+}
+
+// transformWithPlugins applies the output transforms of the registered plugins in order
+func (task *BuildTask) transformWithPlugins(code []byte) ([]byte, error) {
+	plugins := getBuildPlugins()
+	if len(plugins) == 0 {
+		return code, nil
+	}
+	info := task.getBuildInfo()
+	for _, p := range plugins {
+		if p.Transform != nil {
+			ret, err := p.Transform(info, code)
+			if err != nil {
+				return nil, fmt.Errorf("plugin '%s': %v", p.Name, err)
+			}
+			code = ret
+		}
+	}
+	return code, nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterBuildPlugin(t *testing.T) {
+	saved := buildPlugins.list
+	defer func() {
+		buildPlugins.list = saved
+		buildPlugins.id = ""
+	}()
+
+	task := &BuildTask{BuildVersion: 1, Pkg: Pkg{Name: "react", Version: "18.2.0"}, Target: "es2020"}
+	id := task.ID()
+
+	if err := RegisterBuildPlugin(BuildPlugin{Name: "empty"}); err == nil {
+		t.Fatal("should not register a plugin without hooks")
+	}
+	err := RegisterBuildPlugin(BuildPlugin{
+		Name:    "preact-compat",
+		Version: "1.0.0",
+		Resolve: func(info BuildInfo, specifier string, importer string) (string, bool) {
+			if specifier == "react" {
+				return "preact/compat", true
+			}
+			return "", false
+		},
+		Transform: func(info BuildInfo, code []byte) ([]byte, error) {
+			return append([]byte("/* "+info.Package+" */"), code...), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBuildPlugin(BuildPlugin{Name: "preact-compat", Transform: func(BuildInfo, []byte) ([]byte, error) { return nil, nil }}); err == nil {
+		t.Fatal("should not register a plugin twice")
+	}
+
+	task = &BuildTask{BuildVersion: 1, Pkg: Pkg{Name: "react", Version: "18.2.0"}, Target: "es2020"}
+	if task.ID() == id || !strings.HasSuffix(task.ID(), ".p-"+getBuildPluginsID()+".js") {
+		t.Fatalf("the plugins should be folded into the build ID: %s", task.ID())
+	}
+	if s := task.resolveWithPlugins("react", ""); s != "preact/compat" {
+		t.Fatalf("bad resolution: %s", s)
+	}
+	if s := task.resolveWithPlugins("react-dom", ""); s != "react-dom" {
+		t.Fatalf("bad resolution: %s", s)
+	}
+	if code, err := task.transformWithPlugins([]byte("x")); err != nil || string(code) != "/* react */x" {
+		t.Fatalf("bad transform: %s, %v", code, err)
+	}
+}
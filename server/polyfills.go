@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the sources of the nodejs builtin modules:
+//   - "builtin": keep the builtin module import
+//   - "deno-std": the node compatibility module of the deno std library
+//   - "embed": the embedded shim `server/embed/polyfills/node_<name>.js`
+//   - "empty": an empty module
+//   - "throw": a module that throws an error when it's imported
+//   - "npm:<name>@<version>[/submodule]": the polyfill package at the pinned version
+const (
+	polyfillBuiltin = "builtin"
+	polyfillDenoStd = "deno-std"
+	polyfillEmbed   = "embed"
+	polyfillEmpty   = "empty"
+	polyfillThrow   = "throw"
+)
+
+// the strategies of the `?polyfills` query:
+//   - "full": use the sources of the polyfill table (default)
+//   - "minimal": use the embedded shims and the deno std modules only, the polyfill packages are replaced with empty modules
+//   - "none": all builtin modules throw an error apart from the `node` target
+const (
+	polyfillsFull    = "full"
+	polyfillsMinimal = "minimal"
+	polyfillsNone    = "none"
+)
+
+// copy from https://github.com/webpack/webpack/blob/master/lib/ModuleNotFoundError.js#L13
+var polyfillPackages = map[string]string{
+	"assert":         "npm:assert@2.0.0",
+	"console":        "npm:console-browserify@1.2.0",
+	"constants":      "npm:constants-browserify@1.0.0",
+	"crypto":         "npm:crypto-browserify@3.12.0",
+	"domain":         "npm:domain-browser@4.22.0",
+	"events":         "npm:events@3.3.0",
+	"http":           "npm:stream-http@3.2.0",
+	"https":          "npm:https-browserify@1.0.0",
+	"os":             "npm:os-browserify@0.3.0/browser",
+	"path":           "npm:path-browserify@1.0.1",
+	"punycode":       "npm:punycode@2.1.1",
+	"process":        "npm:process@0.11.10/browser",
+	"querystring":    "npm:querystring-es3@0.2.1",
+	"stream":         "npm:stream-browserify@3.0.0",
+	"stream/web":     "npm:web-streams-polyfill@3.2.1",
+	"string_decoder": "npm:string_decoder@1.3.0",
+	"sys":            "npm:util@0.12.4",
+	"timers":         "npm:timers-browserify@2.0.12",
+	"tty":            "npm:tty-browserify@0.0.1",
+	"url":            "npm:url@0.11.0",
+	"util":           "npm:util@0.12.4",
+	"vm":             "npm:vm-browserify@1.1.2",
+	"zlib":           "npm:browserify-zlib@0.2.0",
+}
+
+// the polyfill table maps the builtin module to the sources of the targets,
+// the `*` key is the source of the targets that are not listed.
+var polyfillTable = struct {
+	lock  sync.RWMutex
+	table map[string]map[string]string
+}{
+	table: map[string]map[string]string{},
+}
+
+// loadPolyfills loads the polyfill table from the JSON file, a source applies to all targets
+// or the targets are listed in an object:
+//
+//	{
+//	  "crypto": "empty",
+//	  "path": "npm:path-browserify@1.0.1",
+//	  "fs": { "*": "throw", "deno": "deno-std" }
+//	}
+func loadPolyfills(filename string) (err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return
+	}
+
+	table := map[string]map[string]string{}
+	for name, value := range raw {
+		if !builtInNodeModules[name] {
+			return fmt.Errorf("polyfill '%s': not a nodejs builtin module", name)
+		}
+		var sources map[string]string
+		var source string
+		if json.Unmarshal(value, &source) == nil {
+			sources = map[string]string{"*": source}
+		} else if err = json.Unmarshal(value, &sources); err != nil {
+			return fmt.Errorf("polyfill '%s': the source must be a string or an object of targets", name)
+		}
+		for target, source := range sources {
+			if _, ok := targets[target]; !ok && target != "*" {
+				return fmt.Errorf("polyfill '%s': invalid target '%s'", name, target)
+			}
+			err = validatePolyfillSource(source)
+			if err != nil {
+				return fmt.Errorf("polyfill '%s': %v", name, err)
+			}
+		}
+		table[name] = sources
+	}
+
+	polyfillTable.lock.Lock()
+	polyfillTable.table = table
+	polyfillTable.lock.Unlock()
+	return
+}
+
+func validatePolyfillSource(source string) error {
+	switch source {
+	case polyfillBuiltin, polyfillDenoStd, polyfillEmbed, polyfillEmpty, polyfillThrow:
+		return nil
+	}
+	if strings.HasPrefix(source, "npm:") {
+		_, _, _, err := parsePolyfillPackage(source)
+		return err
+	}
+	return fmt.Errorf("invalid source '%s'", source)
+}
+
+// parsePolyfillPackage parses the package source like `npm:os-browserify@0.3.0/browser`,
+// the version must be pinned.
+func parsePolyfillPackage(source string) (name string, version string, submodule string, err error) {
+	s := strings.TrimPrefix(source, "npm:")
+	i := strings.IndexByte(s, '@')
+	if strings.HasPrefix(s, "@") {
+		i = strings.IndexByte(s[1:], '@')
+		if i >= 0 {
+			i++
+		}
+	}
+	if i <= 0 {
+		err = fmt.Errorf("invalid source '%s': missing version", source)
+		return
+	}
+	name, version = s[:i], s[i+1:]
+	if j := strings.IndexByte(version, '/'); j >= 0 {
+		version, submodule = version[:j], version[j+1:]
+	}
+	if _, _, _, err = splitPkgPath(name); err != nil {
+		err = fmt.Errorf("invalid source '%s': %v", source, err)
+		return
+	}
+	if !regFullVersion.MatchString(version) {
+		err = fmt.Errorf("invalid source '%s': the version must be pinned", source)
+	}
+	return
+}
+
+// parsePolyfillsQuery parses the `?polyfills` query, an empty string is returned for the default strategy
+func parsePolyfillsQuery(raw string) (string, error) {
+	switch raw = strings.TrimSpace(raw); raw {
+	case "", polyfillsFull:
+		return "", nil
+	case polyfillsMinimal, polyfillsNone:
+		return raw, nil
+	}
+	return "", fmt.Errorf("unknown strategy '%s'", raw)
+}
+
+func hasEmbedPolyfill(name string) bool {
+	if embedFS == nil {
+		return false
+	}
+	_, err := embedFS.ReadFile(fmt.Sprintf("server/embed/polyfills/node_%s.js", name))
+	return err == nil
+}
+
+// getDefaultPolyfillSource returns the source of the builtin module for the target if
+// the polyfill table doesn't define it
+func getDefaultPolyfillSource(name string, target string) string {
+	if name == "buffer" {
+		return polyfillEmbed
+	}
+	if target == "deno" && name != "process" {
+		return polyfillDenoStd
+	}
+	if source, ok := polyfillPackages[name]; ok {
+		return source
+	}
+	if hasEmbedPolyfill(name) {
+		return polyfillEmbed
+	}
+	return polyfillThrow
+}
+
+// getPolyfillSource returns the source of the builtin module for the target and the strategy
+func getPolyfillSource(name string, target string, strategy string) string {
+	if target == "node" {
+		return polyfillBuiltin
+	}
+
+	polyfillTable.lock.RLock()
+	sources := polyfillTable.table[name]
+	source, ok := sources[target]
+	if !ok {
+		source, ok = sources["*"]
+	}
+	polyfillTable.lock.RUnlock()
+	if !ok {
+		source = getDefaultPolyfillSource(name, target)
+	}
+
+	switch strategy {
+	case polyfillsNone:
+		if source != polyfillBuiltin {
+			return polyfillThrow
+		}
+	case polyfillsMinimal:
+		if strings.HasPrefix(source, "npm:") {
+			if hasEmbedPolyfill(name) {
+				return polyfillEmbed
+			}
+			return polyfillEmpty
+		}
+	}
+	return source
+}
+
+// getPolyfillsID returns the identity of the polyfill table entries that change the sources of
+// the target, an empty string is returned if the target uses the default sources only.
+func getPolyfillsID(target string) string {
+	if target == "node" || target == "types" {
+		return ""
+	}
+
+	polyfillTable.lock.RLock()
+	entries := []string{}
+	for name, sources := range polyfillTable.table {
+		source, ok := sources[target]
+		if !ok {
+			source, ok = sources["*"]
+		}
+		if ok && source != getDefaultPolyfillSource(name, target) {
+			entries = append(entries, name+"="+source)
+		}
+	}
+	polyfillTable.lock.RUnlock()
+
+	if len(entries) == 0 {
+		return ""
+	}
+	sort.Strings(entries)
+	hasher := sha1.New()
+	hasher.Write([]byte(strings.Join(entries, "\n")))
+	return hex.EncodeToString(hasher.Sum(nil))[:8]
+}
+
+// isEmptyBuiltInNodeModule checks whether the builtin module is replaced with an empty
+// module, which is bundled in the `browser-empty` namespace.
+func (task *BuildTask) isEmptyBuiltInNodeModule(name string) bool {
+	return builtInNodeModules[name] && getPolyfillSource(name, task.Target, task.Polyfills) == polyfillEmpty
+}
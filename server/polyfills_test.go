@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPolyfills(t *testing.T) {
+	savedFS := embedFS
+	embedFS = &devFS{".."}
+	defer func() { embedFS = savedFS }()
+
+	for _, c := range [][4]string{
+		{"fs", "node", "", "builtin"},
+		{"fs", "node", "none", "builtin"},
+		{"buffer", "es2020", "", "embed"},
+		{"path", "deno", "", "deno-std"},
+		{"process", "deno", "", "npm:process@0.11.10/browser"},
+		{"path", "es2020", "", "npm:path-browserify@1.0.1"},
+		{"fs", "es2020", "", "embed"},
+		{"child_process", "es2020", "", "throw"},
+		{"path", "es2020", "minimal", "empty"},
+		{"process", "es2020", "minimal", "embed"},
+		{"path", "deno", "minimal", "deno-std"},
+		{"buffer", "es2020", "none", "throw"},
+		{"path", "deno", "none", "throw"},
+	} {
+		if source := getPolyfillSource(c[0], c[1], c[2]); source != c[3] {
+			t.Fatalf("polyfill of '%s' for %s (%s): expected '%s', got '%s'", c[0], c[1], c[2], c[3], source)
+		}
+	}
+
+	name, version, submodule, err := parsePolyfillPackage("npm:@scope/os@1.0.0/browser")
+	if err != nil || name != "@scope/os" || version != "1.0.0" || submodule != "browser" {
+		t.Fatalf("bad polyfill package: %s %s %s %v", name, version, submodule, err)
+	}
+	if _, _, _, err = parsePolyfillPackage("npm:path-browserify@^1.0.0"); err == nil {
+		t.Fatal("the version of polyfill package should be pinned")
+	}
+
+	if s, err := parsePolyfillsQuery("full"); err != nil || s != "" {
+		t.Fatalf("bad polyfills query: %s %v", s, err)
+	}
+	if _, err := parsePolyfillsQuery("some"); err == nil {
+		t.Fatal("should not parse an unknown polyfills strategy")
+	}
+
+	if id := getPolyfillsID("es2020"); id != "" {
+		t.Fatalf("the default sources should have no ID, got %s", id)
+	}
+
+	saved := polyfillTable.table
+	defer func() { polyfillTable.table = saved }()
+
+	dir, err := ioutil.TempDir("", "esm-polyfills-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "polyfills.json")
+
+	ioutil.WriteFile(filename, []byte(`{"crypto": "empty", "fs": {"*": "throw", "deno": "deno-std"}}`), 0644)
+	err = loadPolyfills(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source := getPolyfillSource("crypto", "deno", ""); source != "empty" {
+		t.Fatalf("bad polyfill of crypto: %s", source)
+	}
+	if source := getPolyfillSource("fs", "es2020", ""); source != "throw" {
+		t.Fatalf("bad polyfill of fs: %s", source)
+	}
+	if source := getPolyfillSource("fs", "deno", ""); source != "deno-std" {
+		t.Fatalf("bad polyfill of fs for deno: %s", source)
+	}
+	// the table is part of the build ID apart from the node target
+	if getPolyfillsID("es2020") == "" || getPolyfillsID("node") != "" {
+		t.Fatal("bad polyfills ID")
+	}
+	if suffix := getIdentitySuffix(Pkg{Name: "react", Version: "18.2.0"}, "es2020", false); !regPfTableSuffix.MatchString(suffix) {
+		t.Fatalf("the polyfill table is not a part of the identity suffix: %s", suffix)
+	}
+
+	for _, bad := range []string{
+		`{"left-pad": "empty"}`,
+		`{"fs": "shim"}`,
+		`{"fs": {"es3": "empty"}}`,
+		`{"path": "npm:path-browserify"}`,
+	} {
+		ioutil.WriteFile(filename, []byte(bad), 0644)
+		if loadPolyfills(filename) == nil {
+			t.Fatalf("should not load the polyfill table %s", bad)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// getModulePreloads returns the build IDs in the dependency closure of the given build, in
+// breadth-first order. The walk is bounded by the `preload-depth` and `preload-limit` options.
+func getModulePreloads(id string, imports []string) []string {
+	if preloadDepth <= 0 || preloadLimit <= 0 {
+		return nil
+	}
+
+	seen := map[string]bool{id: true}
+	preloads := []string{}
+	level := imports
+	for depth := 1; depth <= preloadDepth && len(level) > 0; depth++ {
+		next := []string{}
+		for _, depId := range level {
+			if seen[depId] {
+				continue
+			}
+			seen[depId] = true
+			preloads = append(preloads, depId)
+			if len(preloads) >= preloadLimit {
+				return preloads
+			}
+			if depth < preloadDepth {
+				// embedded polyfills and the builds still in the queue have no meta
+				dep, err := findModule(depId)
+				if err == nil {
+					next = append(next, dep.Imports...)
+				}
+			}
+		}
+		level = next
+	}
+	return preloads
+}
+
+// toModuleImportID converts an import path of a build to the build ID,
+// it returns an empty string if the path is not served by the build storage.
+func toModuleImportID(importPath string) string {
+	if !strings.HasPrefix(importPath, basePath+"/v") {
+		return ""
+	}
+	id := strings.TrimPrefix(importPath, basePath+"/")
+	if !regBuildVersionPath.MatchString("/"+id) || !strings.HasSuffix(id, ".js") {
+		return ""
+	}
+	return id
+}
+
+// formatPreloadLink returns the value of the `Link` header for the given build IDs
+func formatPreloadLink(origin string, ids []string) string {
+	links := make([]string, len(ids))
+	for i, id := range ids {
+		links[i] = fmt.Sprintf("<%s%s/%s>; rel=modulepreload", origin, basePath, id)
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"esm.sh/server/storage"
+)
+
+func TestModulePreloads(t *testing.T) {
+	savedDB, savedFS := db, fs
+	defer func() { db, fs = savedDB, savedFS }()
+	dir := t.TempDir()
+	var err error
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(dir, "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS(fmt.Sprintf("local:%s", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedDepth, savedLimit := preloadDepth, preloadLimit
+	defer func() { preloadDepth, preloadLimit = savedDepth, savedLimit }()
+	preloadDepth, preloadLimit = 2, 16
+
+	task := &BuildTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "react-dom", Version: "18.2.0"},
+		Target:       "es2022",
+	}
+	id := task.ID()
+	react := "v1/react@18.2.0/es2022/react.js"
+	scheduler := "v1/scheduler@0.23.0/es2022/scheduler.js"
+	looseEnvify := "v1/loose-envify@1.4.0/es2022/loose-envify.js"
+	storeModuleMeta(react, &ModuleMeta{Imports: []string{looseEnvify, id}})
+	storeModuleMeta(scheduler, &ModuleMeta{})
+	for _, id := range []string{id, react, scheduler} {
+		fs.WriteData(path.Join("builds", id), []byte("export default null;"))
+	}
+
+	// the preloads are stored with the meta, the build itself is not preloaded
+	task.storeToDB(&ModuleMeta{Imports: []string{react, scheduler}})
+	esm, err := findModule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(esm.Preloads, ",") != strings.Join([]string{react, scheduler, looseEnvify}, ",") {
+		t.Fatalf("bad preloads: %v", esm.Preloads)
+	}
+
+	preloadLimit = 1
+	task = &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: "react-dom", Version: "18.1.0"}, Target: "es2022"}
+	task.storeToDB(&ModuleMeta{Imports: []string{react, scheduler}})
+	fs.WriteData(path.Join("builds", task.ID()), []byte("export default null;"))
+	if esm, err = findModule(task.ID()); err != nil || len(esm.Preloads) != 1 {
+		t.Fatalf("bad preloads with the limit: %v %v", esm, err)
+	}
+}
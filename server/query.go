@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -54,7 +55,7 @@ func query(devMode bool) rex.Handle {
 		// ban malicious requests by banList
 		for prefix := range banList {
 			if strings.HasPrefix(pathname, prefix) {
-				return rex.Status(403, "forbidden")
+				return serveError(ctx, newServerError(ErrForbidden, "forbidden"))
 			}
 		}
 
@@ -97,6 +98,11 @@ func query(devMode bool) rex.Handle {
 			}
 		}
 
+		// serve the admin API
+		if strings.HasPrefix(pathname, "/_admin/") {
+			return serveAdmin(ctx, pathname)
+		}
+
 		// match static routess
 		switch pathname {
 		case "/":
@@ -118,49 +124,28 @@ func query(devMode bool) rex.Handle {
 			ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
 			return rex.Content("index.html", startTime, bytes.NewReader(html))
 
+		case "/status/events":
+			return serveBuildEvents(buildEvents.subscribe(""), nil)
+
 		case "/status.json":
-			buildQueue.lock.RLock()
-			q := make([]map[string]interface{}, buildQueue.list.Len())
-			i := 0
-			for el := buildQueue.list.Front(); el != nil; el = el.Next() {
-				t, ok := el.Value.(*queueTask)
-				if ok {
-					m := map[string]interface{}{
-						"stage":      t.stage,
-						"createTime": t.createTime.Format(http.TimeFormat),
-						"consumers":  t.consumers,
-						"pkg":        t.Pkg.String(),
-						"target":     t.Target,
-						"inProcess":  t.inProcess,
-						"devMode":    t.DevMode,
-						"bundleMode": t.BundleMode,
-					}
-					if !t.startTime.IsZero() {
-						m["startTime"] = t.startTime.Format(http.TimeFormat)
-					}
-					if len(t.Deps) > 0 {
-						m["deps"] = t.Deps.String()
-					}
-					q[i] = m
-					i++
-				}
-			}
-			buildQueue.lock.RUnlock()
+			// the details of the tasks are served by the admin API
 			return map[string]interface{}{
 				"uptime": time.Since(startTime).String(),
-				"queue":  q[:i],
+				"queue":  buildQueue.summary(),
 			}
 
 		case "/error.js":
 			switch ctx.Form.Value("type") {
 			case "resolve":
-				return throwErrorJS(ctx, fmt.Errorf(
+				return throwErrorJS(ctx, newServerError(
+					ErrResolveFailed,
 					`Can't resolve "%s" (Imported by "%s")`,
 					ctx.Form.Value("name"),
 					ctx.Form.Value("importer"),
 				))
 			case "unsupported-nodejs-builtin-module":
-				return throwErrorJS(ctx, fmt.Errorf(
+				return throwErrorJS(ctx, newServerError(
+					ErrUnsupportedBuiltin,
 					`Unsupported nodejs builtin module "%s" (Imported by "%s")`,
 					ctx.Form.Value("name"),
 					ctx.Form.Value("importer"),
@@ -169,6 +154,9 @@ func query(devMode bool) rex.Handle {
 				return throwErrorJS(ctx, fmt.Errorf("Unknown error"))
 			}
 
+		case "/bundle":
+			return serveBundle(ctx, getOrigin(ctx.R.Host))
+
 		case "/favicon.ico":
 			return rex.Status(404, "not found")
 		}
@@ -201,17 +189,44 @@ func query(devMode bool) rex.Handle {
 			}
 		}
 
+		// serve combined bundle files
+		if hasBuildVerPrefix && strings.HasPrefix(pathname, "/~bundle/") {
+			var savePath string
+			if outdatedBuildVer != "" {
+				savePath = path.Join("builds", outdatedBuildVer, pathname)
+			} else {
+				savePath = path.Join("builds", fmt.Sprintf("v%d", VERSION), pathname)
+			}
+			exists, size, modtime, err := fs.Exists(savePath)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if !exists {
+				return rex.Status(404, "File not found")
+			}
+			r, err := fs.ReadFile(savePath, size)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+			return rex.Content(savePath, modtime, r)
+		}
+
+		// check `before` query
+		before, err := parseBeforeQuery(ctx.Form.Value("before"))
+		if err != nil {
+			return rex.Status(400, fmt.Sprintf("Invalid before query: %v", err))
+		}
+
+		// list the versions of the package
+		if ctx.Form.Has("versions") && !hasBuildVerPrefix {
+			return servePackageVersions(ctx, pathname, before)
+		}
+
 		// get package info
-		reqPkg, _, err := parsePkg(pathname)
+		reqPkg, _, err := parsePkg(pathname, before)
 		if err != nil {
-			status := 500
-			message := err.Error()
-			if message == "invalid path" {
-				status = 400
-			} else if strings.HasSuffix(message, "not found") {
-				status = 404
-			}
-			return rex.Status(status, message)
+			return throwErrorJS(ctx, err)
 		}
 
 		origin := getOrigin(ctx.R.Host)
@@ -366,6 +381,11 @@ func query(devMode bool) rex.Handle {
 				savePath = path.Join(storageType, fmt.Sprintf("v%d", VERSION), pathname)
 			}
 
+			// serve the build log of the `?log` query
+			if storageType == "builds" && ctx.Form.Has("log") {
+				return serveBuildLog(ctx, strings.TrimPrefix(savePath, "builds/"))
+			}
+
 			exists, size, modtime, err := fs.Exists(savePath)
 			if err != nil {
 				return rex.Status(500, err.Error())
@@ -378,6 +398,17 @@ func query(devMode bool) rex.Handle {
 				}
 				if storageType == "types" {
 					ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
+				} else if strings.HasSuffix(savePath, ".js") {
+					id := strings.TrimPrefix(savePath, "builds/")
+					if esm, err := findModule(id); err == nil {
+						if err := getVerificationError(esm); err != nil {
+							return throwErrorJS(ctx, err)
+						}
+						setWarningsHeader(ctx, esm)
+						if len(esm.Preloads) > 0 {
+							ctx.SetHeader("Link", formatPreloadLink(getOrigin(ctx.R.Host), esm.Preloads))
+						}
+					}
 				}
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 				return rex.Content(savePath, modtime, r)
@@ -399,28 +430,9 @@ func query(devMode bool) rex.Handle {
 		}
 
 		// check `deps` query
-		deps := PkgSlice{}
-
-		// add equivalent of ?deps=react@18 to every lib
-		depsArr := strings.Split(ctx.Form.Value("deps"), ",")
-		depsArr = append(depsArr, "react@0.0.0-experimental-7a4336c40-20220712")
-		depsArr = append(depsArr, "react-dom@0.0.0-experimental-7a4336c40-20220712")
-		depsArr = append(depsArr, "@microsoft/fast-element@2.0.0-beta.3") // TODO: remove when we're on non-alpha/beta fast-foundation/element
-
-		for _, p := range depsArr {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				m, _, err := parsePkg(p)
-				if err != nil {
-					if strings.HasSuffix(err.Error(), "not found") {
-						continue
-					}
-					return rex.Status(400, fmt.Sprintf("Invalid deps query: %v not found", p))
-				}
-				if !deps.Has(m.Name) {
-					deps = append(deps, *m)
-				}
-			}
+		deps, err := parseDepsQuery(ctx.Form.Value("deps"), before)
+		if err != nil {
+			return rex.Status(400, err.Error())
 		}
 
 		// FIXME: everything is pinned to es2020 until oscar supports separate bundles for different es
@@ -446,6 +458,9 @@ func query(devMode bool) rex.Handle {
 
 		isBare := false
 		isPkgCss := ctx.Form.Has("css")
+		isPreload := ctx.Form.Has("preload")
+		isAnalyze := ctx.Form.Has("analyze")
+		isSplitting := ctx.Form.Has("split")
 		isBundleMode := ctx.Form.Has("bundle")
 		isDev := ctx.Form.Has("dev")
 		isPined := ctx.Form.Has("pin")
@@ -454,6 +469,18 @@ func query(devMode bool) rex.Handle {
 		noRequire := ctx.Form.Has("no-require")
 		keepNames := ctx.Form.Has("keep-names")
 		ignoreAnnotations := ctx.Form.Has("ignore-annotations")
+		exports, err := parseExportsQuery(ctx.Form.Value("exports"))
+		if err != nil {
+			return rex.Status(400, fmt.Sprintf("Invalid exports query: %v", err))
+		}
+		conditions, err := parseConditionsQuery(ctx.Form.Value("conditions"))
+		if err != nil {
+			return rex.Status(400, fmt.Sprintf("Invalid conditions query: %v", err))
+		}
+		polyfills, err := parsePolyfillsQuery(ctx.Form.Value("polyfills"))
+		if err != nil {
+			return rex.Status(400, fmt.Sprintf("Invalid polyfills query: %v", err))
+		}
 
 		// force react/jsx-dev-runtime and react-refresh into `dev` mode
 		if !isDev {
@@ -486,11 +513,18 @@ func query(devMode bool) rex.Handle {
 		alias, deps = fixAliasDeps(alias, deps, reqPkg.Name)
 
 		// check whether it is `bare` mode
+		var bareIdentity *string
 		if hasBuildVerPrefix && endsWith(pathname, ".js") {
 			a := strings.Split(reqPkg.Submodule, "/")
 			if len(a) > 1 {
 				if _, ok := targets[a[0]]; ok {
 					submodule := strings.TrimSuffix(strings.Join(a[1:], "/"), ".js")
+					// the build ID records the `before` time, the query and the server default are ignored
+					before = time.Time{}
+					if endsWith(submodule, ".split") {
+						submodule = strings.TrimSuffix(submodule, ".split")
+						isSplitting = true
+					}
 					if endsWith(submodule, ".bundle") {
 						submodule = strings.TrimSuffix(submodule, ".bundle")
 						isBundleMode = true
@@ -499,6 +533,28 @@ func query(devMode bool) rex.Handle {
 						submodule = strings.TrimSuffix(submodule, ".development")
 						isDev = true
 					}
+					// the identity of the plugins, overrides, substitutions and polyfill table is
+					// checked after the task is created
+					identity := ""
+					for _, reg := range []*regexp.Regexp{regPfTableSuffix, regSubstSuffix, regOverridesSuffix, regPluginsSuffix} {
+						if m := reg.FindStringSubmatch(submodule); m != nil {
+							submodule = strings.TrimSuffix(submodule, m[0])
+							identity = m[0] + identity
+						}
+					}
+					bareIdentity = &identity
+					if m := regBeforeSuffix.FindStringSubmatch(submodule); m != nil {
+						unix, err := strconv.ParseInt(m[1], 10, 64)
+						if err != nil {
+							return rex.Status(400, "Invalid before suffix")
+						}
+						before = time.Unix(unix, 0).UTC()
+						submodule = strings.TrimSuffix(submodule, m[0])
+					}
+					if m := regPolyfillsSuffix.FindStringSubmatch(submodule); m != nil {
+						polyfills = m[1]
+						submodule = strings.TrimSuffix(submodule, m[0])
+					}
 					if endsWith(submodule, ".ia") {
 						submodule = strings.TrimSuffix(submodule, ".ia")
 						ignoreAnnotations = true
@@ -511,6 +567,26 @@ func query(devMode bool) rex.Handle {
 						submodule = strings.TrimSuffix(submodule, ".nr")
 						noRequire = true
 					}
+					if m := regConditionsSuffix.FindStringSubmatch(submodule); m != nil {
+						s, err := atobUrl(m[1])
+						if err == nil {
+							conditions, err = parseConditionsQuery(s)
+						}
+						if err != nil {
+							return rex.Status(400, "Invalid conditions suffix")
+						}
+						submodule = strings.TrimSuffix(submodule, m[0])
+					}
+					if m := regExportsSuffix.FindStringSubmatch(submodule); m != nil {
+						s, err := atobUrl(m[1])
+						if err == nil {
+							exports, err = parseExportsQuery(s)
+						}
+						if err != nil {
+							return rex.Status(400, "Invalid exports suffix")
+						}
+						submodule = strings.TrimSuffix(submodule, m[0])
+					}
 					pkgName := path.Base(reqPkg.Name)
 					if submodule == pkgName || (strings.HasSuffix(pkgName, ".js") && submodule+".js" == pkgName) {
 						submodule = ""
@@ -522,6 +598,10 @@ func query(devMode bool) rex.Handle {
 			}
 		}
 
+		if isSplitting && len(exports) > 0 {
+			return rex.Status(400, "The `split` query can't be used with the `exports` query")
+		}
+
 		if hasBuildVerPrefix && storageType == "types" {
 			task := &BuildTask{
 				CdnOrigin:    origin,
@@ -561,11 +641,12 @@ func query(devMode bool) rex.Handle {
 				select {
 				case output := <-c.C:
 					if output.err != nil {
-						return rex.Status(500, "types: "+output.err.Error())
+						e := toServerError(asBuildError(output.err))
+						return serveError(ctx, &ServerError{Code: e.Code, Message: "types: " + e.Message})
 					}
 				case <-time.After(time.Minute):
 					buildQueue.RemoveConsumer(task, c)
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
+					return serveError(ctx, newServerError(ErrTimeout, "timeout, we are transforming the types hardly, please try again later!"))
 				}
 			}
 			if err != nil {
@@ -596,9 +677,31 @@ func query(devMode bool) rex.Handle {
 			NoRequire:         noRequire,
 			KeepNames:         keepNames,
 			IgnoreAnnotations: ignoreAnnotations,
+			Exports:           exports,
+			Splitting:         isSplitting,
+			Before:            before,
+			Conditions:        conditions,
+			Polyfills:         polyfills,
 			stage:             "init",
 		}
+		// the url of a build that is built with other plugins, overrides, substitutions or
+		// polyfill table is served with the exact build only, it's not rebuilt with the current ones
+		if bareIdentity != nil && *bareIdentity != getIdentitySuffix(task.Pkg, task.Target, task.BundleMode) {
+			task.identity = bareIdentity
+			if _, err := findModule(task.ID()); err != nil {
+				if err != storage.ErrNotFound {
+					return rex.Status(500, err.Error())
+				}
+				return throwErrorJS(ctx, newServerError(ErrPackageNotFound, "the build '%s' is not found, it's built with the outdated server settings", task.ID()))
+			}
+		}
 		taskID := task.ID()
+		if ctx.Form.Has("log") {
+			return serveBuildLog(ctx, taskID)
+		}
+		if ctx.Form.Has("progress") {
+			return serveBuildProgress(task)
+		}
 		esm, err := findModule(taskID)
 		if err != nil && err != storage.ErrNotFound {
 			return rex.Status(500, err.Error())
@@ -619,11 +722,19 @@ func query(devMode bool) rex.Handle {
 				}
 			}
 
+			// the build failed recently, serve the failure record until the retry time
+			failure, failing := findPendingBuildFailure(task.ID())
+
 			// if the previous build exists and is not pin/bare mode, then build current module in backgound,
 			// or wait the current build task for 30 seconds
 			if esm != nil {
 				// todo: maybe don't build?
-				buildQueue.Add(task, "")
+				if !failing {
+					buildQueue.Add(task, "")
+				}
+			} else if failing {
+				ctx.SetHeader("Retry-After", strconv.Itoa(int(time.Until(failure.RetryAt).Seconds())+1))
+				return throwErrorJS(ctx, &ServerError{Code: failure.Code, Message: failure.Error})
 			} else {
 				c := buildQueue.Add(task, ctx.RemoteIP())
 				select {
@@ -634,11 +745,20 @@ func query(devMode bool) rex.Handle {
 					esm = output.meta
 				case <-time.After(time.Minute):
 					buildQueue.RemoveConsumer(task, c)
-					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
+					return throwErrorJS(ctx, newServerError(ErrTimeout, "timeout, we are building the package hardly, please try again later!"))
 				}
 			}
 		}
 
+		// redo the expired verification in background, the expired result is ignored meanwhile
+		if taskID == task.ID() && isVerificationExpired(esm) {
+			go task.verify(esm)
+		}
+		if err := getVerificationError(esm); err != nil {
+			return throwErrorJS(ctx, err)
+		}
+		setWarningsHeader(ctx, esm)
+
 		if esm.TypesOnly {
 			if esm.Dts != "" && !noCheck {
 				value := fmt.Sprintf(
@@ -654,6 +774,19 @@ func query(devMode bool) rex.Handle {
 			return []byte("export default null;\n")
 		}
 
+		if isAnalyze {
+			metafileID := taskID
+			if esm.Metafile != "" {
+				metafileID = esm.Metafile
+			}
+			report, err := analyzeBuild(taskID, metafileID, *reqPkg)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return report
+		}
+
 		if isPkgCss {
 			if !esm.PackageCSS {
 				return rex.Status(404, "Package CSS not found")
@@ -696,6 +829,11 @@ func query(devMode bool) rex.Handle {
 				)
 				ctx.SetHeader("X-TypeScript-Types", value)
 			}
+			if !isPkgCss {
+				if len(esm.Preloads) > 0 {
+					ctx.SetHeader("Link", formatPreloadLink(origin, esm.Preloads))
+				}
+			}
 			ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 			return rex.Content(savePath, modtime, r)
 		}
@@ -703,11 +841,22 @@ func query(devMode bool) rex.Handle {
 		buf := bytes.NewBuffer(nil)
 
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, "\n")
+		if !isWorker {
+			if len(esm.Preloads) > 0 {
+				ctx.SetHeader("Link", formatPreloadLink(origin, esm.Preloads))
+			}
+			// flatten the waterfall by importing the dependencies statically
+			if isPreload {
+				for _, id := range esm.Preloads {
+					fmt.Fprintf(buf, `import "%s%s/%s";%s`, origin, basePath, id, "\n")
+				}
+			}
+		}
 		if isWorker {
 			fmt.Fprintf(buf, `export default function workerFactory() {%s  return new Worker('%s/%s', { type: 'module' })%s}`, "\n", origin, taskID, "\n")
 		} else {
 			fmt.Fprintf(buf, `export * from "%s%s/%s";%s`, origin, basePath, taskID, "\n")
-			if esm.CJS || esm.ExportDefault {
+			if esm.ExportDefault || (esm.CJS && len(exports) == 0) {
 				fmt.Fprintf(
 					buf,
 					`export { default } from "%s%s/%s";%s`,
@@ -731,12 +880,8 @@ func query(devMode bool) rex.Handle {
 
 		if regFullVersionPath.MatchString(pathname) {
 			if isPined {
-				if targeted {
-					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-				} else {
-					ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
-					ctx.SetHeader("Vary", "User-Agent")
-				}
+				// the build target is pinned, so the response doesn't vary by `User-Agent`
+				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 			} else {
 				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 24*3600)) // cache for 24 hours
 				ctx.SetHeader("Vary", "User-Agent")
@@ -750,17 +895,39 @@ func query(devMode bool) rex.Handle {
 	}
 }
 
-func throwErrorJS(ctx *rex.Context, err error) interface{} {
-	buf := bytes.NewBuffer(nil)
-	fmt.Fprintf(buf, "/* esm.sh - error */\n")
-	fmt.Fprintf(
-		buf,
-		`throw new Error("[esm.sh] " + %s);%s`,
-		strings.TrimSpace(string(utils.MustEncodeJSON(err.Error()))),
-		"\n",
-	)
-	fmt.Fprintf(buf, "export default null;\n")
-	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
-	ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
-	return rex.Status(500, buf)
+// setWarningsHeader sets the `X-ESM-Warnings` header with the build warnings of the module
+func setWarningsHeader(ctx *rex.Context, esm *ModuleMeta) {
+	if len(esm.Warnings) > 0 {
+		ctx.SetHeader("X-ESM-Warnings", strings.Join(esm.Warnings, "; "))
+	}
+}
+
+// the deps that are added to every lib, equivalent of ?deps=react@18
+var implicitDeps = []string{
+	"react@0.0.0-experimental-7a4336c40-20220712",
+	"react-dom@0.0.0-experimental-7a4336c40-20220712",
+	"@microsoft/fast-element@2.0.0-beta.3", // TODO: remove when we're on non-alpha/beta fast-foundation/element
+}
+
+func parseDepsQuery(raw string, before time.Time) (deps PkgSlice, err error) {
+	deps = PkgSlice{}
+
+	depsArr := append(strings.Split(raw, ","), implicitDeps...)
+
+	for _, p := range depsArr {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			m, _, e := parsePkg(p, before)
+			if e != nil {
+				if isNotFoundError(e) {
+					continue
+				}
+				return nil, fmt.Errorf("Invalid deps query: %v not found", p)
+			}
+			if !deps.Has(m.Name) {
+				deps = append(deps, *m)
+			}
+		}
+	}
+	return
 }
@@ -2,7 +2,7 @@ package server
 
 import (
 	"container/list"
-	"fmt"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -14,6 +14,7 @@ type BuildQueue struct {
 	tasks        map[string]*queueTask
 	processes    []*queueTask
 	maxProcesses int
+	paused       bool
 }
 
 type BuildQueueConsumer struct {
@@ -33,6 +34,7 @@ type queueTask struct {
 	createTime time.Time
 	startTime  time.Time
 	consumers  []*BuildQueueConsumer
+	canceled   bool
 }
 
 func (t *queueTask) run() BuildOutput {
@@ -52,7 +54,7 @@ func (t *queueTask) run() BuildOutput {
 		}
 	case <-time.After(5 * time.Minute):
 		log.Errorf("build %s: timeout(%v)", t.ID(), time.Since(t.startTime))
-		output = BuildOutput{err: fmt.Errorf("build ")}
+		output = BuildOutput{err: newServerError(ErrTimeout, "build timeout")}
 	}
 
 	return output
@@ -102,11 +104,30 @@ func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer
 	q.tasks[task.ID()] = t
 	q.lock.Unlock()
 
+	buildEvents.publish(newBuildEvent("queued", task))
 	q.next()
 
 	return c
 }
 
+// getTaskEvent returns the event of the current state of the task in the queue
+func (q *BuildQueue) getTaskEvent(id string) (e BuildEvent, ok bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	t, ok := q.tasks[id]
+	if !ok {
+		return
+	}
+	if t.inProcess {
+		e = newBuildEvent("stage", t.BuildTask)
+		e.Stage = t.stage
+	} else {
+		e = newBuildEvent("queued", t.BuildTask)
+	}
+	return
+}
+
 func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
@@ -125,10 +146,144 @@ func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
 	}
 }
 
+// Cancel cancels the task, its consumers get the "canceled" error. The build of a task in process
+// can't be interrupted, so the task keeps its process until the build returns, the consumers that
+// come after the cancellation get the result of the build.
+func (q *BuildQueue) Cancel(id string) bool {
+	q.lock.Lock()
+	t, ok := q.tasks[id]
+	if !ok {
+		q.lock.Unlock()
+		return false
+	}
+	if t.inProcess {
+		t.canceled = true
+	} else {
+		q.list.Remove(t.el)
+		delete(q.tasks, id)
+	}
+	consumers := t.consumers
+	t.consumers = []*BuildQueueConsumer{}
+	q.lock.Unlock()
+
+	err := newServerError(ErrCanceled, "build canceled")
+	for _, c := range consumers {
+		c.C <- BuildOutput{err: err}
+	}
+	e := newBuildEvent("failed", t.BuildTask)
+	e.Error = err
+	buildEvents.publish(e)
+	return true
+}
+
+// Bump moves the queued task to the front of the queue, so it's the next task to start.
+func (q *BuildQueue) Bump(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t, ok := q.tasks[id]
+	if !ok {
+		return false
+	}
+	if !t.inProcess {
+		q.list.MoveToFront(t.el)
+	}
+	return true
+}
+
+// Pause stops starting the queued tasks, the tasks in process are not affected.
+func (q *BuildQueue) Pause() {
+	q.lock.Lock()
+	q.paused = true
+	q.lock.Unlock()
+}
+
+// Resume resumes the paused queue.
+func (q *BuildQueue) Resume() {
+	q.lock.Lock()
+	q.paused = false
+	q.lock.Unlock()
+
+	q.next()
+}
+
+// SetMaxProcesses changes the number of the concurrent build processes, the extra processes
+// are not stopped when the number is decreased but no new task starts until they finish.
+func (q *BuildQueue) SetMaxProcesses(n int) {
+	q.lock.Lock()
+	q.maxProcesses = n
+	q.lock.Unlock()
+
+	q.next()
+}
+
+// summary returns the public summary of the queue
+func (q *BuildQueue) summary() map[string]interface{} {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return map[string]interface{}{
+		"length":       q.list.Len(),
+		"processes":    len(q.processes),
+		"maxProcesses": q.maxProcesses,
+		"paused":       q.paused,
+	}
+}
+
+// listTasks returns the details of the tasks in the queue for the admin API
+func (q *BuildQueue) listTasks() []map[string]interface{} {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	list := make([]map[string]interface{}, 0, q.list.Len())
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if !ok {
+			continue
+		}
+		m := map[string]interface{}{
+			"id":         t.ID(),
+			"stage":      t.stage,
+			"createTime": t.createTime.Format(http.TimeFormat),
+			"age":        time.Since(t.createTime).Round(time.Millisecond).String(),
+			"consumers":  t.consumers,
+			"pkg":        t.Pkg.String(),
+			"target":     t.Target,
+			"inProcess":  t.inProcess,
+			"canceled":   t.canceled,
+			"devMode":    t.DevMode,
+			"bundleMode": t.BundleMode,
+		}
+		if len(t.Entries) > 0 {
+			m["entries"] = t.Entries.String()
+		}
+		if !t.startTime.IsZero() {
+			m["startTime"] = t.startTime.Format(http.TimeFormat)
+		}
+		if len(t.Deps) > 0 {
+			m["deps"] = t.Deps.String()
+		}
+		if len(t.Exports) > 0 {
+			m["exports"] = t.Exports
+		}
+		if len(t.Conditions) > 0 {
+			m["conditions"] = t.Conditions
+		}
+		if t.Polyfills != "" {
+			m["polyfills"] = t.Polyfills
+		}
+		list = append(list, m)
+	}
+	return list
+}
+
+// next starts the queued tasks until all processes are busy, nothing is started while the queue is paused.
 func (q *BuildQueue) next() {
-	var nextTask *queueTask
 	q.lock.Lock()
-	if len(q.processes) < q.maxProcesses {
+	defer q.lock.Unlock()
+
+	for !q.paused && len(q.processes) < q.maxProcesses {
+		var nextTask *queueTask
 		for el := q.list.Front(); el != nil; el = el.Next() {
 			t, ok := el.Value.(*queueTask)
 			if ok && !t.inProcess {
@@ -136,26 +291,31 @@ func (q *BuildQueue) next() {
 				break
 			}
 		}
+		if nextTask == nil {
+			return
+		}
+		nextTask.inProcess = true
+		q.processes = append(q.processes, nextTask)
+		go q.wait(nextTask)
 	}
-	q.lock.Unlock()
-
-	if nextTask == nil {
-		return
-	}
-
-	q.lock.Lock()
-	nextTask.inProcess = true
-	q.processes = append(q.processes, nextTask)
-	q.lock.Unlock()
-
-	go q.wait(nextTask)
 }
 
 func (q *BuildQueue) wait(t *queueTask) {
 	t.startTime = time.Now()
+	buildEvents.publish(newBuildEvent("started", t.BuildTask))
 
 	output := t.run()
 
+	// record the failure before the task leaves the queue, so the following requests are
+	// served with the failure record instead of rebuilding
+	if output.err != nil {
+		if _, err := recordBuildFailure(t.ID(), output.err); err != nil {
+			log.Errorf("record build failure(%s): %v", t.ID(), err)
+		}
+	} else if err := clearBuildFailure(t.ID()); err != nil {
+		log.Errorf("clear build failure(%s): %v", t.ID(), err)
+	}
+
 	q.lock.Lock()
 	a := make([]*queueTask, len(q.processes))
 	i := 0
@@ -168,12 +328,25 @@ func (q *BuildQueue) wait(t *queueTask) {
 	q.processes = a[0:i]
 	q.list.Remove(t.el)
 	delete(q.tasks, t.ID())
+	consumers := t.consumers
 	q.lock.Unlock()
 
 	// call next task
 	q.next()
 
-	for _, c := range t.consumers {
+	for _, c := range consumers {
 		c.C <- output
 	}
+
+	if output.err != nil {
+		e := newBuildEvent("failed", t.BuildTask)
+		e.Error = toServerError(output.err)
+		buildEvents.publish(e)
+	} else {
+		buildEvents.publish(newBuildEvent("done", t.BuildTask))
+	}
+
+	if output.err == nil {
+		t.verify(output.meta)
+	}
 }
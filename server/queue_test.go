@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestBuildQueueControl(t *testing.T) {
+	q := newBuildQueue(2)
+	q.Pause()
+
+	newTask := func(name string) *BuildTask {
+		return &BuildTask{BuildVersion: VERSION, Pkg: Pkg{Name: name, Version: "1.0.0"}, Target: "es2022"}
+	}
+	a, b := newTask("a"), newTask("b")
+	c := q.Add(a, "1.2.3.4")
+	q.Add(b, "")
+	if summary := q.summary(); summary["length"] != 2 || summary["processes"] != 0 || summary["paused"] != true {
+		t.Fatalf("the paused queue should not start tasks: %v", summary)
+	}
+
+	if !q.Bump(b.ID()) || q.Bump("v1/c@1.0.0/es2022/c.js") {
+		t.Fatal("bad bump result")
+	}
+	tasks := q.listTasks()
+	if len(tasks) != 2 || tasks[0]["id"] != b.ID() || tasks[1]["id"] != a.ID() {
+		t.Fatalf("the bumped task should be the first: %v", tasks)
+	}
+
+	if !q.Cancel(a.ID()) {
+		t.Fatal("the task should be canceled")
+	}
+	output := <-c.C
+	if getErrorCode(output.err) != ErrCanceled {
+		t.Fatalf("bad output of the canceled task: %v", output.err)
+	}
+	if q.Cancel(a.ID()) || q.Len() != 1 {
+		t.Fatal("the canceled task should leave the queue")
+	}
+
+	// the task in process keeps its process until the build returns
+	d := newTask("d")
+	c = q.Add(d, "1.2.3.4")
+	q.lock.Lock()
+	td := q.tasks[d.ID()]
+	td.inProcess = true
+	q.processes = append(q.processes, td)
+	q.lock.Unlock()
+	if !q.Cancel(d.ID()) {
+		t.Fatal("the task in process should be canceled")
+	}
+	if output := <-c.C; getErrorCode(output.err) != ErrCanceled {
+		t.Fatalf("bad output of the canceled task: %v", output.err)
+	}
+	if summary := q.summary(); summary["processes"] != 1 || summary["length"] != 2 {
+		t.Fatalf("the canceled task in process should keep its process: %v", summary)
+	}
+	q.lock.Lock()
+	q.processes = nil
+	q.list.Remove(td.el)
+	delete(q.tasks, d.ID())
+	q.lock.Unlock()
+
+	// no process is available to start the task
+	q.SetMaxProcesses(0)
+	q.Resume()
+	if summary := q.summary(); summary["processes"] != 0 || summary["maxProcesses"] != 0 || summary["paused"] != false {
+		t.Fatalf("bad summary: %v", summary)
+	}
+}
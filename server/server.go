@@ -43,6 +43,14 @@ var (
 	origin string
 	// unpkg.com origin
 	unpkgOrigin string
+	// max depth of the dependency tree to preload
+	preloadDepth int
+	// max number of modules to preload
+	preloadLimit int
+	// resolve packages with the versions published before the time by default
+	defaultBefore time.Time
+	// fail the builds that have validation warnings instead of storing them
+	strictBuild bool
 )
 
 type EmbedFS interface {
@@ -56,6 +64,9 @@ func Serve(efs EmbedFS) {
 		httpsPort        int
 		buildConcurrency int
 		etcDir           string
+		overridesDir     string
+		substitutionFile string
+		polyfillFile     string
 		cacheUrl         string
 		dbUrl            string
 		fsUrl            string
@@ -63,12 +74,17 @@ func Serve(efs EmbedFS) {
 		logDir           string
 		noCompress       bool
 		isDev            bool
+		verifyBuilds     bool
+		before           string
 	)
 	flag.IntVar(&port, "port", 80, "http server port")
 	flag.IntVar(&httpsPort, "https-port", 0, "https(autotls) server port, default is disabled")
 	flag.StringVar(&basePath, "basepath", "", "base path")
 	flag.BoolVar(&baseRedirect, "base-redirect", false, "http redrect for URLs not from basepath")
 	flag.StringVar(&etcDir, "etc-dir", ".esmd", "etc dir")
+	flag.StringVar(&overridesDir, "overrides-dir", "", "package overrides dir, default is '[etc-dir]/overrides'")
+	flag.StringVar(&substitutionFile, "substitutions", "", "the JSON file of the module substitution table")
+	flag.StringVar(&polyfillFile, "polyfills", "", "the JSON file of the nodejs builtin module polyfill table")
 	flag.StringVar(&cacheUrl, "cache", "", "cache config, default is 'memory:default'")
 	flag.StringVar(&dbUrl, "db", "", "database config, default is 'postdb:[etc-dir]/esm.db'")
 	flag.StringVar(&fsUrl, "fs", "", "filesystem config, default is 'local:[etc-dir]/storage'")
@@ -76,13 +92,28 @@ func Serve(efs EmbedFS) {
 	flag.StringVar(&logDir, "log-dir", "", "log dir")
 	flag.StringVar(&logLevel, "log-level", "info", "log level")
 	flag.BoolVar(&noCompress, "no-compress", false, "disable compression for text content")
+	flag.BoolVar(&strictBuild, "strict-build", false, "fail the builds that have validation warnings")
+	flag.BoolVar(&verifyBuilds, "verify-builds", false, "load the finished builds in a node process to catch the evaluation errors, the process runs the code of npm packages with network access")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ESM_ADMIN_TOKEN"), "the bearer token of the admin API, default is the 'ESM_ADMIN_TOKEN' env")
 	flag.BoolVar(&isDev, "dev", false, "run server in development mode")
 	flag.StringVar(&npmRegistry, "npm-registry", "", "npm registry")
 	flag.StringVar(&origin, "origin", "", "the server origin, default is the request host")
 	flag.StringVar(&unpkgOrigin, "unpkg-origin", "https://unpkg.com/", "unpkg.com origin")
+	flag.IntVar(&preloadDepth, "preload-depth", 2, "max depth of the dependency tree to preload, 0 to disable")
+	flag.IntVar(&preloadLimit, "preload-limit", 16, "max number of modules to preload")
+	flag.StringVar(&before, "before", "", "resolve packages with the versions published before the time(RFC3339) by default")
 
 	flag.Parse()
 
+	if before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			fmt.Printf("bad before time: %v\n", err)
+			os.Exit(1)
+		}
+		defaultBefore = t.UTC()
+	}
+
 	var err error
 	etcDir, err = filepath.Abs(etcDir)
 	if err != nil {
@@ -102,6 +133,12 @@ func Serve(efs EmbedFS) {
 	if logDir == "" {
 		logDir = path.Join(etcDir, "log")
 	}
+	if verifyBuilds {
+		verifyOrigin = fmt.Sprintf("http://localhost:%d", port)
+	}
+	if overridesDir == "" {
+		overridesDir = path.Join(etcDir, "overrides")
+	}
 
 	if isDev {
 		logLevel = "debug"
@@ -157,6 +194,30 @@ func Serve(efs EmbedFS) {
 		log.Fatalf("init storage(fs,%s): %v", fsUrl, err)
 	}
 
+	// load the package overrides, the changes of the overrides dir are picked up every minute
+	overrideList, err := loadOverrides(overridesDir)
+	if err != nil {
+		log.Fatalf("load overrides: %v", err)
+	}
+	setOverrides(overrideList)
+	go cron(time.Minute, func() {
+		reloadOverrides(overridesDir)
+	})
+
+	if substitutionFile != "" {
+		err = loadSubstitutions(substitutionFile)
+		if err != nil {
+			log.Fatalf("load substitutions: %v", err)
+		}
+	}
+
+	if polyfillFile != "" {
+		err = loadPolyfills(polyfillFile)
+		if err != nil {
+			log.Fatalf("load polyfills: %v", err)
+		}
+	}
+
 	buildQueue = newBuildQueue(buildConcurrency)
 
 	var accessLogger *logx.Logger
@@ -202,7 +263,7 @@ func Serve(efs EmbedFS) {
 				http.MethodGet,
 			},
 			AllowedHeaders:   []string{"*"},
-			ExposedHeaders:   []string{"X-TypeScript-Types"},
+			ExposedHeaders:   []string{"X-TypeScript-Types", "X-ESM-Error", "X-ESM-Warnings", "Link"},
 			AllowCredentials: false,
 		}),
 		query(isDev),
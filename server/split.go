@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// splitEntry defines an entry of the code splitting build
+type splitEntry struct {
+	task      *BuildTask
+	esm       *ModuleMeta
+	npm       *NpmPackage
+	inputPath string
+}
+
+// getSplitEntries returns the entries of the code splitting build keyed by the output name,
+// the entries are the submodules defined in the `exports` of package.json.
+func (task *BuildTask) getSplitEntries(esm *ModuleMeta, npm *NpmPackage, tracing *stringSet) (entries map[string]*splitEntry, err error) {
+	submodules := []string{task.Pkg.Submodule}
+	if task.Pkg.Submodule != "" {
+		submodules = append(submodules, "")
+	}
+	if m, ok := npm.DefinedExports.(*orderedMap); ok {
+		for _, name := range m.Keys() {
+			// todo: support pattern exports like `./*`
+			if !strings.HasPrefix(name, "./") || strings.ContainsRune(name, '*') || endsWith(name, "/", ".json", ".css", ".d.ts") {
+				continue
+			}
+			submodule := strings.TrimSuffix(strings.TrimPrefix(name, "./"), ".js")
+			if submodule != task.Pkg.Submodule {
+				submodules = append(submodules, submodule)
+			}
+		}
+	}
+
+	entriesDir := path.Join(task.wd, "entries")
+	err = ensureDir(entriesDir)
+	if err != nil {
+		return
+	}
+
+	buildDir := task.getBuildDir()
+	entries = map[string]*splitEntry{}
+	for _, submodule := range submodules {
+		entry := &splitEntry{task: task, esm: esm, npm: npm}
+		if submodule != task.Pkg.Submodule {
+			subTask := &BuildTask{
+				wd:                task.wd, // use current wd to avoid reinstall
+				CdnOrigin:         task.CdnOrigin,
+				BuildVersion:      task.BuildVersion,
+				Pkg:               Pkg{Name: task.Pkg.Name, Version: task.Pkg.Version, Submodule: submodule},
+				Alias:             task.Alias,
+				Deps:              task.Deps,
+				Target:            task.Target,
+				DevMode:           task.DevMode,
+				BundleMode:        task.BundleMode,
+				NoRequire:         task.NoRequire,
+				KeepNames:         task.KeepNames,
+				IgnoreAnnotations: task.IgnoreAnnotations,
+				Splitting:         true,
+				Before:            task.Before,
+				Conditions:        task.Conditions,
+				Polyfills:         task.Polyfills,
+			}
+			if tracing.Has(subTask.ID()) {
+				continue
+			}
+			subEsm, subNpm, e := initModule(task.wd, subTask.Pkg, task.Target, task.DevMode, task.Conditions)
+			// ignore the submodules that can't be resolved or are types only
+			if e != nil || (subNpm.Main == "" && subNpm.Module == "") {
+				log.Debugf("split(%s): skip submodule '%s': %v", task.ID(), submodule, e)
+				continue
+			}
+			tracing.Add(subTask.ID())
+			entry = &splitEntry{task: subTask, esm: subEsm, npm: subNpm}
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.task.ID(), buildDir+"/"), ".js")
+		entry.inputPath = path.Join(entriesDir, identify(name)+".js")
+		err = ioutil.WriteFile(entry.inputPath, getEntryModule(entry.task.Pkg.ImportPath(), entry.esm, entry.npm), 0644)
+		if err != nil {
+			return
+		}
+		entries[name] = entry
+	}
+	return
+}
+
+// recordChunkImports records the external imports of the shared chunks on the entries that import
+// the chunks directly or through other chunks, the imports of the outputs are read from the esbuild
+// metafile. The entries and the chunk imports are keyed by the output paths of esbuild.
+func recordChunkImports(metafile string, wd string, entries map[string]*ModuleMeta, chunkImports map[string][]string) error {
+	var meta esbuildMetafile
+	err := json.Unmarshal([]byte(metafile), &meta)
+	if err != nil {
+		return err
+	}
+
+	// the paths of the metafile are relative to the working directory
+	outputImports := map[string][]string{}
+	for outputPath, output := range meta.Outputs {
+		outputPath = path.Join(wd, outputPath)
+		for _, imp := range output.Imports {
+			outputImports[outputPath] = append(outputImports[outputPath], path.Join(wd, imp.Path))
+		}
+	}
+
+	for outputPath, esm := range entries {
+		imports := newStringSet()
+		for _, id := range esm.Imports {
+			imports.Add(id)
+		}
+		seen := map[string]bool{}
+		queue := outputImports[outputPath]
+		for len(queue) > 0 {
+			chunk := queue[0]
+			queue = queue[1:]
+			if seen[chunk] {
+				continue
+			}
+			seen[chunk] = true
+			for _, id := range chunkImports[chunk] {
+				if !imports.Has(id) {
+					imports.Add(id)
+					esm.Imports = append(esm.Imports, id)
+				}
+			}
+			queue = append(queue, outputImports[chunk]...)
+		}
+	}
+	return nil
+}
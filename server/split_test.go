@@ -0,0 +1,36 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecordChunkImports(t *testing.T) {
+	metafile := `{
+		"inputs": {},
+		"outputs": {
+			"../../esbuild/a.js": {"imports": [{"path": "../../esbuild/_chunks/chunk-A.js", "kind": "import-statement"}]},
+			"../../esbuild/sub/b.js": {"imports": [{"path": "../../esbuild/_chunks/chunk-B.js", "kind": "import-statement"}]},
+			"../../esbuild/_chunks/chunk-A.js": {"imports": [{"path": "../../esbuild/_chunks/chunk-B.js", "kind": "import-statement"}]},
+			"../../esbuild/_chunks/chunk-B.js": {"imports": []}
+		}
+	}`
+	a := &ModuleMeta{Imports: []string{"v1/react@18.2.0/es2022/react.js"}}
+	b := &ModuleMeta{}
+	entries := map[string]*ModuleMeta{"/esbuild/a.js": a, "/esbuild/sub/b.js": b}
+	chunkImports := map[string][]string{
+		"/esbuild/_chunks/chunk-A.js": {"v1/react@18.2.0/es2022/react.js", "v1/scheduler@0.23.0/es2022/scheduler.js"},
+		"/esbuild/_chunks/chunk-B.js": {"v1/loose-envify@1.4.0/es2022/loose-envify.js"},
+	}
+	err := recordChunkImports(metafile, "/tmp/esm-build-wd", entries, chunkImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the imports of the chunks imported through other chunks are recorded without duplicates
+	if strings.Join(a.Imports, ",") != "v1/react@18.2.0/es2022/react.js,v1/scheduler@0.23.0/es2022/scheduler.js,v1/loose-envify@1.4.0/es2022/loose-envify.js" {
+		t.Fatalf("bad imports of a: %v", a.Imports)
+	}
+	if strings.Join(b.Imports, ",") != "v1/loose-envify@1.4.0/es2022/loose-envify.js" {
+		t.Fatalf("bad imports of b: %v", b.Imports)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/utils"
+)
+
+// Substitution defines a replacement of the module specifier, one of the `Package`,
+// `Expression` and `Error` should be set.
+type Substitution struct {
+	// Package replaces the module with another package like `node-fetch-native@0.1.3`
+	Package string `json:"package,omitempty"`
+	// Expression replaces the module with an inline JS expression like `Object.assign`
+	Expression string `json:"expression,omitempty"`
+	// Error fails the build with the message
+	Error string `json:"error,omitempty"`
+	// Targets limits the substitution to the build targets, a target with the `!` prefix is
+	// excluded, the substitution applies to all targets (including `types`) if it's empty.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// the built-in substitutions, the builds with the built-in table have no substitutions ID
+var builtinSubstitutions = map[string]Substitution{
+	"node-fetch":    {Package: "node-fetch-native@0.1.3", Targets: []string{"!node"}},
+	"object-assign": {Expression: "Object.assign"},
+}
+
+var substitutions = struct {
+	lock  sync.RWMutex
+	table map[string]Substitution
+}{
+	table: copySubstitutions(builtinSubstitutions),
+}
+
+func copySubstitutions(table map[string]Substitution) map[string]Substitution {
+	m := make(map[string]Substitution, len(table))
+	for k, v := range table {
+		m[k] = v
+	}
+	return m
+}
+
+// loadSubstitutions loads the substitution table from the JSON file, the entries override
+// the built-in ones with the same specifier, an empty entry removes the built-in one.
+func loadSubstitutions(filename string) (err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	var table map[string]Substitution
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return
+	}
+
+	substitutions.lock.Lock()
+	defer substitutions.lock.Unlock()
+
+	for specifier, sub := range table {
+		n := 0
+		for _, s := range []string{sub.Package, sub.Expression, sub.Error} {
+			if s != "" {
+				n++
+			}
+		}
+		if n == 0 {
+			delete(substitutions.table, specifier)
+			continue
+		}
+		if n > 1 {
+			return fmt.Errorf("substitution '%s': only one of `package`, `expression` and `error` can be set", specifier)
+		}
+		if sub.Package != "" {
+			_, _, _, err = splitPkgPath(sub.Package)
+			if err != nil {
+				return fmt.Errorf("substitution '%s': %v", specifier, err)
+			}
+		}
+		substitutions.table[specifier] = sub
+	}
+	return
+}
+
+// findSubstitution returns the substitution of the module specifier for the build target
+func findSubstitution(specifier string, target string) (sub Substitution, ok bool) {
+	substitutions.lock.RLock()
+	defer substitutions.lock.RUnlock()
+
+	sub, ok = substitutions.table[specifier]
+	return sub, ok && sub.appliesTo(target)
+}
+
+// appliesTo checks whether the substitution applies to the build target
+func (sub Substitution) appliesTo(target string) bool {
+	if len(sub.Targets) == 0 {
+		return true
+	}
+	included := false
+	hasIncludes := false
+	for _, t := range sub.Targets {
+		if strings.HasPrefix(t, "!") {
+			if t[1:] == target {
+				return false
+			}
+		} else {
+			hasIncludes = true
+			if t == target {
+				included = true
+			}
+		}
+	}
+	return included || !hasIncludes
+}
+
+// getSubstitutionsID returns the identity of the substitutions that apply to the build target,
+// an empty string is returned if they are the same as the built-in ones.
+func getSubstitutionsID(target string) string {
+	substitutions.lock.RLock()
+	effective := filterSubstitutions(substitutions.table, target)
+	substitutions.lock.RUnlock()
+
+	if reflect.DeepEqual(effective, filterSubstitutions(builtinSubstitutions, target)) {
+		return ""
+	}
+	// the keys of the map are sorted by the json encoder
+	hasher := sha1.New()
+	hasher.Write(utils.MustEncodeJSON(effective))
+	return hex.EncodeToString(hasher.Sum(nil))[:8]
+}
+
+func filterSubstitutions(table map[string]Substitution, target string) map[string]Substitution {
+	m := map[string]Substitution{}
+	for specifier, sub := range table {
+		if sub.appliesTo(target) {
+			m[specifier] = sub
+		}
+	}
+	return m
+}
+
+// resolveSubstitution resolves the inline expression or the error substitution of the module
+// specifier in the esbuild resolver, the expression is loaded in the `substitution` namespace.
+func resolveSubstitution(specifier string, target string) (result api.OnResolveResult, ok bool, err error) {
+	sub, ok := findSubstitution(specifier, target)
+	if !ok {
+		return
+	}
+	if sub.Error != "" {
+		return result, true, fmt.Errorf("could not import \"%s\": %s", specifier, sub.Error)
+	}
+	if sub.Expression != "" {
+		return api.OnResolveResult{Path: specifier, Namespace: "substitution"}, true, nil
+	}
+	return result, false, nil
+}
+
+// loadSubstitution loads the module of the inline expression substitution
+func loadSubstitution(specifier string, target string) (api.OnLoadResult, error) {
+	sub, ok := findSubstitution(specifier, target)
+	if !ok || sub.Expression == "" {
+		return api.OnLoadResult{}, fmt.Errorf("substitution of \"%s\" not found", specifier)
+	}
+	contents := fmt.Sprintf("module.exports = %s;", sub.Expression)
+	return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSubstitutions(t *testing.T) {
+	if sub, ok := findSubstitution("node-fetch", "es2020"); !ok || sub.Package != "node-fetch-native@0.1.3" {
+		t.Fatalf("bad built-in substitution: %v", sub)
+	}
+	if _, ok := findSubstitution("node-fetch", "node"); ok {
+		t.Fatal("the `node-fetch` substitution should not apply to node target")
+	}
+	if _, ok := findSubstitution("node-fetch", "types"); !ok {
+		t.Fatal("the `node-fetch` substitution should apply to types")
+	}
+
+	if id := getSubstitutionsID("es2020"); id != "" {
+		t.Fatalf("the built-in substitutions should have no ID, got %s", id)
+	}
+
+	saved := substitutions.table
+	substitutions.table = map[string]Substitution{}
+	for k, v := range saved {
+		substitutions.table[k] = v
+	}
+	defer func() { substitutions.table = saved }()
+
+	dir, err := ioutil.TempDir("", "esm-substitutions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "substitutions.json")
+
+	ioutil.WriteFile(filename, []byte(`{"object-assign": {}, "fsevents": {"error": "macOS only", "targets": ["deno", "es2020"]}}`), 0644)
+	err = loadSubstitutions(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := findSubstitution("object-assign", "es2020"); ok {
+		t.Fatal("the `object-assign` substitution should be removed")
+	}
+	if _, ok, err := resolveSubstitution("fsevents", "es2020"); !ok || err == nil {
+		t.Fatal("the `fsevents` substitution should be an error")
+	}
+	if _, ok := findSubstitution("fsevents", "es2015"); ok {
+		t.Fatal("the `fsevents` substitution should not apply to es2015 target")
+	}
+	// the table is part of the build ID
+	id := getSubstitutionsID("es2020")
+	if id == "" || id == getSubstitutionsID("es2015") || getSubstitutionsID("es2015") == "" {
+		t.Fatalf("bad substitutions ID: %s", id)
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"x": {"package": "y@1.0.0", "expression": "{}"}}`), 0644)
+	if loadSubstitutions(filename) == nil {
+		t.Fatal("should not load a substitution with both package and expression")
+	}
+}
@@ -22,6 +22,16 @@ var (
 	regFullVersionPath  = regexp.MustCompile(`([^/])@\d+\.\d+\.\d+[a-zA-Z0-9\.\+\-_]*(/|$)`)
 	regBuildVersionPath = regexp.MustCompile(`^/v\d+/`)
 	regLocPath          = regexp.MustCompile(`(\.[a-z]+):\d+:\d+$`)
+	regExportsSuffix    = regexp.MustCompile(`\.e-([a-zA-Z0-9_\-]+)$`)
+	regConditionsSuffix = regexp.MustCompile(`\.c-([a-zA-Z0-9_\-]+)$`)
+	regCondition        = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_\-]*$`)
+	regBeforeSuffix     = regexp.MustCompile(`\.b-(\d+)$`)
+	regPolyfillsSuffix  = regexp.MustCompile(`\.pf-(minimal|none)$`)
+	regPluginsSuffix    = regexp.MustCompile(`\.p-([0-9a-f]{8})$`)
+	regOverridesSuffix  = regexp.MustCompile(`\.o-([0-9a-f]{8})$`)
+	regSubstSuffix      = regexp.MustCompile(`\.s-([0-9a-f]{8})$`)
+	regPfTableSuffix    = regexp.MustCompile(`\.pt-([0-9a-f]{8})$`)
+	regJSIdentifier     = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*$`)
 	npmNaming           = valid.Validator{valid.FromTo{'a', 'z'}, valid.FromTo{'0', '9'}, valid.Eq('.'), valid.Eq('_'), valid.Eq('-')}
 )
 
@@ -82,6 +92,15 @@ func identify(importPath string) string {
 	return string(p)
 }
 
+// getPkgName returns the package name of a bare specifier like `@scope/name/submodule`
+func getPkgName(specifier string) string {
+	a := strings.Split(specifier, "/")
+	if strings.HasPrefix(specifier, "@") && len(a) > 1 {
+		return a[0] + "/" + a[1]
+	}
+	return a[0]
+}
+
 func isRemoteImport(importPath string) bool {
 	return strings.HasPrefix(importPath, "https://") || strings.HasPrefix(importPath, "http://")
 }
@@ -199,6 +218,62 @@ func fixAliasDeps(alias map[string]string, deps PkgSlice, pkgName string) (map[s
 	return _alias, _pkgs
 }
 
+// parseExportsQuery parses the `?exports` query to a sorted name list
+func parseExportsQuery(raw string) (exports []string, err error) {
+	set := newStringSet()
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !regJSIdentifier.MatchString(name) {
+			return nil, fmt.Errorf("invalid export name '%s'", name)
+		}
+		set.Add(name)
+	}
+	exports = set.Values()
+	sort.Strings(exports)
+	return
+}
+
+// parseConditionsQuery parses the `?conditions` query to a condition list, the order is kept
+// since the former condition takes precedence.
+func parseConditionsQuery(raw string) (conditions []string, err error) {
+	set := newStringSet()
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || set.Has(name) {
+			continue
+		}
+		if !regCondition.MatchString(name) {
+			return nil, fmt.Errorf("invalid condition '%s'", name)
+		}
+		set.Add(name)
+		conditions = append(conditions, name)
+	}
+	return
+}
+
+// parseBeforeQuery parses the `?before` query in RFC3339 or `YYYY-MM-DD` format,
+// the server default is used if the query is empty.
+func parseBeforeQuery(raw string) (before time.Time, err error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return defaultBefore, nil
+	}
+	before, err = time.Parse(time.RFC3339, raw)
+	if err != nil {
+		before, err = time.Parse("2006-01-02", raw)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s'", raw)
+	}
+	if before.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("time '%s' is in the future", raw)
+	}
+	return before.UTC(), nil
+}
+
 func decodeAliasDepsPrefix(raw string) (alias map[string]string, deps PkgSlice, err error) {
 	s, err := atobUrl(strings.TrimPrefix(strings.TrimSuffix(raw, "/"), "X-"))
 	if err == nil {
@@ -220,9 +295,9 @@ func decodeAliasDepsPrefix(raw string) (alias map[string]string, deps PkgSlice,
 				for _, p := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(p, "d/"), "deps:"), ",") {
 					p = strings.TrimSpace(p)
 					if p != "" {
-						m, _, err := parsePkg(p)
+						m, _, err := parsePkg(p, time.Time{})
 						if err != nil {
-							if strings.HasSuffix(err.Error(), "not found") {
+							if isNotFoundError(err) {
 								continue
 							}
 							return nil, nil, err
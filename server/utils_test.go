@@ -22,3 +22,35 @@ func TestAliasDepsPrefix(t *testing.T) {
 	}
 	t.Log(a, d)
 }
+
+func TestParseBeforeQuery(t *testing.T) {
+	before, err := parseBeforeQuery("2022-07-01T08:00:00+08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Unix() != 1656633600 {
+		t.Fatalf("invalid before time %v", before)
+	}
+	before, err = parseBeforeQuery("2022-07-01")
+	if err != nil || before.Unix() != 1656633600 {
+		t.Fatalf("invalid before time %v", before)
+	}
+	for _, raw := range []string{"yesterday", "2999-01-01"} {
+		if _, err = parseBeforeQuery(raw); err == nil {
+			t.Fatalf("'%s' should be invalid", raw)
+		}
+	}
+}
+
+func TestParseConditionsQuery(t *testing.T) {
+	conditions, err := parseConditionsQuery("react-server, worker,edge-light,worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conditions) != 3 || conditions[0] != "react-server" || conditions[1] != "worker" || conditions[2] != "edge-light" {
+		t.Fatalf("invalid conditions %v", conditions)
+	}
+	if _, err = parseConditionsQuery("./foo"); err == nil {
+		t.Fatal("'./foo' should be invalid")
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ije/esbuild-internal/ast"
+	"github.com/ije/esbuild-internal/js_ast"
+	"github.com/ije/esbuild-internal/js_parser"
+	"github.com/ije/esbuild-internal/logger"
+	"github.com/ije/esbuild-internal/test"
+)
+
+// the node globals that are not available in the browser or in es modules
+var nodeGlobals = map[string]bool{
+	"__dirname":    true,
+	"__filename":   true,
+	"global":       true,
+	"process":      true,
+	"Buffer":       true,
+	"setImmediate": true,
+}
+
+// checkOutput validates the output file of the build and records the warnings in the module meta,
+// an error is returned instead if the `strict-build` option is enabled.
+func (task *BuildTask) checkOutput(esm *ModuleMeta, filename string, code []byte) error {
+	warnings := task.validateOutput(code)
+	if len(warnings) == 0 {
+		return nil
+	}
+	for _, warning := range warnings {
+		log.Warnf("validate(%s): %s: %s", task.ID(), filename, warning)
+		task.logf("warning", "%s: %s", filename, warning)
+	}
+	if strictBuild {
+		return fmt.Errorf("validate %s: %s", filename, strings.Join(warnings, "; "))
+	}
+	esm.Warnings = append(esm.Warnings, warnings...)
+	return nil
+}
+
+// validateOutput parses the final build output and returns the leftovers that break the module
+// at runtime: `require()` calls, node globals, imports of the unsupported builtin modules and
+// the unresolved bare specifiers.
+func (task *BuildTask) validateOutput(code []byte) (warnings []string) {
+	source := test.SourceForTest(string(code))
+	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug)
+	tree, ok := js_parser.Parse(log, source, js_parser.Options{})
+	if !ok {
+		msg := "failed to parse the build output"
+		for _, m := range log.Done() {
+			if m.Kind == logger.Error {
+				msg += ": " + m.Data.Text
+				break
+			}
+		}
+		return []string{msg}
+	}
+
+	seen := newStringSet()
+	warn := func(format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		if !seen.Has(msg) {
+			seen.Add(msg)
+			warnings = append(warnings, msg)
+		}
+	}
+
+	for _, record := range tree.ImportRecords {
+		specifier := record.Path.Text
+		switch record.Kind {
+		case ast.ImportRequire, ast.ImportRequireResolve:
+			warn("`require(\"%s\")` is not available in es modules", specifier)
+			continue
+		case ast.ImportStmt, ast.ImportDynamic:
+		default:
+			continue
+		}
+		if strings.HasPrefix(specifier, basePath+"/error.js?") {
+			query, _ := url.ParseQuery(strings.SplitN(specifier, "?", 2)[1])
+			if query.Get("type") == "unsupported-nodejs-builtin-module" {
+				warn("unsupported nodejs builtin module \"%s\"", query.Get("name"))
+			} else {
+				warn("import of \"%s\" throws an error", specifier)
+			}
+			continue
+		}
+		if isLocalImport(specifier) || isRemoteImport(specifier) || startsWith(specifier, "/", "data:") {
+			continue
+		}
+		if task.Target == "node" && builtInNodeModules[strings.TrimPrefix(specifier, "node:")] {
+			continue
+		}
+		warn("unresolved bare specifier \"%s\"", specifier)
+	}
+
+	v := &astVisitor{expr: func(expr js_ast.Expr) bool {
+		switch e := expr.Data.(type) {
+		case *js_ast.EUnary:
+			// `typeof __dirname` is safe
+			if _, ok := e.Value.Data.(*js_ast.EIdentifier); ok && e.Op == js_ast.UnOpTypeof {
+				return false
+			}
+		case *js_ast.ECall:
+			// the `__require` shim of esbuild is always emitted with the cjs modules, but it only throws
+			// for the calls that are left after the external references are rewritten
+			if id, ok := e.Target.Data.(*js_ast.EIdentifier); ok && tree.Symbols[id.Ref.InnerIndex].OriginalName == "__require" {
+				warn("dynamic `require()` calls are not supported in es modules")
+			}
+		case *js_ast.EIdentifier:
+			symbol := tree.Symbols[e.Ref.InnerIndex]
+			if symbol.Kind == js_ast.SymbolUnbound && nodeGlobals[symbol.OriginalName] {
+				name := symbol.OriginalName
+				// the node target provides the node globals apart from `__dirname` and `__filename`
+				if task.Target != "node" || name == "__dirname" || name == "__filename" {
+					warn("node global `%s` is not defined", name)
+				}
+			}
+		}
+		return true
+	}}
+	for _, part := range tree.Parts {
+		v.visitStmts(part.Stmts)
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func TestValidateOutput(t *testing.T) {
+	code := strings.Join([]string{
+		`import a from "/error.js?type=unsupported-nodejs-builtin-module&name=fs&importer=x";`,
+		`import b from "lodash";`,
+		`import c from "/v1/react@18.0.0/es2020/react.js";`,
+		`import d from "https://deno.land/std@0.130.0/node/path.ts";`,
+		`const { dirname } = { dirname: 1 };`,
+		`console.log(a, b, c, d, dirname, __dirname, typeof process, Buffer.from("x"));`,
+		`var __require = (x) => { throw new Error('Dynamic require of "' + x + '" is not supported') };`,
+	}, "\n")
+	task := &BuildTask{Target: "es2020"}
+	warnings := task.validateOutput([]byte(code))
+	expected := []string{
+		`unsupported nodejs builtin module "fs"`,
+		`unresolved bare specifier "lodash"`,
+		"node global `__dirname` is not defined",
+		"node global `Buffer` is not defined",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+
+	task = &BuildTask{Target: "node"}
+	warnings = task.validateOutput([]byte(`import fs from "node:fs"; import path from "path"; fs.readFileSync(path.join(process.cwd(), __filename));`))
+	if len(warnings) != 1 || warnings[0] != "node global `__filename` is not defined" {
+		t.Fatalf("unexpected warnings for node target: %v", warnings)
+	}
+
+	warnings = task.validateOutput([]byte(`export default {`))
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "failed to parse the build output") {
+		t.Fatalf("unexpected warnings for broken output: %v", warnings)
+	}
+}
+
+func TestValidateCJSOutput(t *testing.T) {
+	// a cjs module with an external, and a `require()` call that can't be resolved at build time
+	build := func(contents string) []byte {
+		result := api.Build(api.BuildOptions{
+			Stdin:    &api.StdinOptions{Contents: contents, Sourcefile: "index.js"},
+			Bundle:   true,
+			Format:   api.FormatESModule,
+			Target:   api.ES2020,
+			External: []string{externalPrefix + "*"},
+		})
+		if len(result.Errors) > 0 {
+			t.Fatal(result.Errors[0].Text)
+		}
+		return result.OutputFiles[0].Contents
+	}
+	rewrite := func(code []byte) []byte {
+		refs, err := findExternalRefs(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allRefs := []externalRef{}
+		replacements := []string{}
+		for name, list := range refs {
+			for _, ref := range list {
+				allRefs = append(allRefs, ref)
+				replacements = append(replacements, "__"+name+"$")
+			}
+		}
+		return rewriteExternalRefs(code, allRefs, replacements)
+	}
+
+	task := &BuildTask{Target: "es2020"}
+	code := build(`const ext = require("` + externalPrefix + `ext"); module.exports = ext.foo;`)
+	if !strings.Contains(string(code), `Dynamic require of "`) {
+		t.Fatal("the output should have the `__require` shim")
+	}
+	if warnings := task.validateOutput(rewrite(code)); len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+
+	code = build(`const name = "ext"; module.exports = [require("` + externalPrefix + `ext"), require(name)];`)
+	warnings := task.validateOutput(rewrite(code))
+	if len(warnings) != 1 || warnings[0] != "dynamic `require()` calls are not supported in es modules" {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
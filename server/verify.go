@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+// the verifier loads the es module and its dependencies from the server in a browser-like context,
+// then prints the result as JSON
+const verifierApp = `
+  const vm = require('vm')
+  const webGlobals = [
+    'URL', 'URLSearchParams', 'TextEncoder', 'TextDecoder', 'AbortController', 'AbortSignal',
+    'Event', 'EventTarget', 'Blob', 'atob', 'btoa', 'fetch', 'Headers', 'Request', 'Response',
+    'FormData', 'crypto', 'performance', 'queueMicrotask', 'structuredClone'
+  ]
+  // a reference error of the node globals means the module is broken in browsers, while
+  // the other missing globals may be browser APIs that the sandbox doesn't provide
+  const nodeGlobals = new Set([
+    'process', 'Buffer', 'global', 'require', 'module', 'exports', '__dirname', '__filename', 'setImmediate'
+  ])
+
+  // an inert stub of the DOM objects: any property is a stub, calling or constructing returns a stub
+  function domStub() {
+    return new Proxy(function () {}, {
+      get: (target, key) => {
+        if (key === Symbol.toPrimitive) return () => ''
+        if (typeof key === 'symbol' || key === 'then') return undefined
+        if (!(key in target)) target[key] = domStub()
+        return target[key]
+      },
+      apply: () => domStub(),
+      construct: () => domStub()
+    })
+  }
+
+  function memoryStorage() {
+    const data = new Map()
+    return {
+      get length() { return data.size },
+      key: i => Array.from(data.keys())[i] ?? null,
+      getItem: key => data.has(String(key)) ? data.get(String(key)) : null,
+      setItem: (key, value) => { data.set(String(key), String(value)) },
+      removeItem: key => { data.delete(String(key)) },
+      clear: () => data.clear()
+    }
+  }
+
+  // the browser globals that are commonly touched at module evaluation time
+  function browserGlobals(url, setTimeout, clearTimeout) {
+    const location = new URL(url)
+    return {
+      document: domStub(),
+      navigator: { userAgent: 'Mozilla/5.0 (esm.sh verifier)', language: 'en-US', languages: ['en-US'], platform: '', onLine: true, hardwareConcurrency: 1 },
+      location: Object.assign(domStub(), {
+        href: location.href, origin: location.origin, protocol: location.protocol, host: location.host,
+        hostname: location.hostname, port: location.port, pathname: location.pathname, search: location.search, hash: location.hash,
+        toString: () => location.href
+      }),
+      history: domStub(),
+      screen: { width: 1280, height: 720, availWidth: 1280, availHeight: 720 },
+      innerWidth: 1280,
+      innerHeight: 720,
+      devicePixelRatio: 1,
+      localStorage: memoryStorage(),
+      sessionStorage: memoryStorage(),
+      addEventListener() {},
+      removeEventListener() {},
+      dispatchEvent: () => true,
+      matchMedia: media => ({ media, matches: false, onchange: null, addListener() {}, removeListener() {}, addEventListener() {}, removeEventListener() {} }),
+      getComputedStyle: () => domStub(),
+      requestAnimationFrame: fn => setTimeout(() => fn(Date.now()), 16),
+      cancelAnimationFrame: timer => clearTimeout(timer),
+      customElements: domStub(),
+      HTMLElement: domStub(),
+      Element: domStub(),
+      Node: domStub(),
+      MutationObserver: domStub(),
+      ResizeObserver: domStub(),
+      IntersectionObserver: domStub()
+    }
+  }
+
+  function isInconclusiveError(e) {
+    // the code generation from strings is disallowed in the verifier
+    if (e && (e.inconclusive || e.name === 'EvalError')) {
+      return true
+    }
+    const m = e && e.name === 'ReferenceError' && /^(\S+) is not defined$/.exec(e.message)
+    return !!m && !nodeGlobals.has(m[1])
+  }
+
+  // loads the es module and its dependencies from the server in a browser-like context,
+  // returns the export names of the module
+  async function verifyModule({ url, timeout }) {
+    const timers = new Set()
+    const sandbox = {
+      console: { log() {}, info() {}, warn() {}, error() {}, debug() {}, trace() {} },
+      setTimeout: (fn, ms, ...args) => {
+        const timer = setTimeout(() => {
+          timers.delete(timer)
+          try { typeof fn === 'function' && fn(...args) } catch (e) {}
+        }, ms)
+        timers.add(timer)
+        return timer
+      },
+      setInterval: (fn, ms, ...args) => {
+        const timer = setInterval(() => {
+          try { typeof fn === 'function' && fn(...args) } catch (e) {}
+        }, ms)
+        timers.add(timer)
+        return timer
+      },
+      clearTimeout: timer => { timers.delete(timer); clearTimeout(timer) },
+      clearInterval: timer => { timers.delete(timer); clearInterval(timer) },
+    }
+    for (const name of webGlobals) {
+      if (name in globalThis) {
+        sandbox[name] = globalThis[name]
+      }
+    }
+    Object.assign(sandbox, browserGlobals(url, sandbox.setTimeout, sandbox.clearTimeout))
+    const context = vm.createContext(sandbox)
+    vm.runInContext('globalThis.window = globalThis.self = globalThis', context)
+
+    const modules = new Map()
+    const load = specifier => {
+      if (!modules.has(specifier)) {
+        modules.set(specifier, fetch(specifier).then(async res => {
+          const text = await res.text()
+          if (!res.ok) {
+            // the dependency may be still in building
+            const err = new Error('fetch ' + specifier + ': ' + res.status + ' ' + text.slice(0, 200))
+            err.inconclusive = res.status !== 404
+            throw err
+          }
+          return new vm.SourceTextModule(text, { identifier: specifier, context })
+        }))
+      }
+      return modules.get(specifier)
+    }
+    const run = async () => {
+      const mod = await load(url)
+      await mod.link((specifier, referencingModule) => load(new URL(specifier, referencingModule.identifier).href))
+      await mod.evaluate()
+      return { exports: Object.keys(mod.namespace) }
+    }
+
+    let timer
+    try {
+      return await Promise.race([
+        run(),
+        new Promise(resolve => { timer = setTimeout(() => resolve({ timeout: true }), timeout) })
+      ])
+    } catch (e) {
+      return { error: e && e.message || String(e), inconclusive: isInconclusiveError(e) }
+    } finally {
+      clearTimeout(timer)
+      for (const t of timers) {
+        clearTimeout(t)
+      }
+    }
+  }
+
+  // the verifier runs in a short-lived process for each build, the errors that are thrown
+  // asynchronously by the module don't change the result
+  process.on('uncaughtException', () => {})
+  process.on('unhandledRejection', () => {})
+
+  verifyModule({ url: process.argv[2], timeout: parseInt(process.argv[3]) }).then(ret => {
+    process.stdout.write(JSON.stringify(ret) + '\n', () => process.exit(0))
+  })
+`
+
+// ModuleVerification is the result of loading the build in the node services process
+type ModuleVerification struct {
+	Exports []string `json:"exports,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	// Time is the unix time of the verification, the result expires after `verificationTTL`
+	Time int64 `json:"t,omitempty"`
+}
+
+type verifyModuleResult struct {
+	Exports      []string `json:"exports"`
+	Timeout      bool     `json:"timeout"`
+	Error        string   `json:"error"`
+	Inconclusive bool     `json:"inconclusive"`
+}
+
+// the origin that the verifier loads the builds from, the verification is disabled if it's empty
+var verifyOrigin string
+
+// the timeout of loading a build and its dependencies in milliseconds
+const verifyTimeout = 20000
+
+// the memory limit of the verifier process in megabytes
+const verifyMaxMemory = 256
+
+// the verification is redone after the ttl, so a false failure doesn't last
+const verificationTTL = 24 * time.Hour
+
+// the builds that are being verified
+var verifying sync.Map
+
+// verifyModule loads the module of the url and its dependencies in a child node process, the
+// process is killed after the timeout.
+func verifyModule(url string) (ret verifyModuleResult, err error) {
+	args, err := getVerifierArgs()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout*time.Millisecond+5*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "node", append(args, url, strconv.Itoa(verifyTimeout))...)
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return verifyModuleResult{Timeout: true}, nil
+	}
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+			err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(e.Stderr))
+		}
+		return
+	}
+	err = json.Unmarshal(output, &ret)
+	return
+}
+
+var verifier struct {
+	once sync.Once
+	args []string
+	err  error
+}
+
+// getVerifierArgs writes the verifier script and returns the arguments of the node process.
+// `vm` is not a security boundary, so the verifier runs in its own process with limited memory,
+// without the code generation from strings that the known sandbox escapes depend on, and with
+// the permission model of node 20+ that denies the file system writes and the child processes.
+func getVerifierArgs() ([]string, error) {
+	verifier.once.Do(func() {
+		f, err := ioutil.TempFile("", "esm-verifier-*.js")
+		if err != nil {
+			verifier.err = err
+			return
+		}
+		defer f.Close()
+		if _, err = f.WriteString(verifierApp); err != nil {
+			verifier.err = err
+			return
+		}
+		args := []string{
+			"--experimental-vm-modules",
+			"--no-warnings",
+			"--disallow-code-generation-from-strings",
+			fmt.Sprintf("--max-old-space-size=%d", verifyMaxMemory),
+		}
+		if _, major, err := getNodejsVersion(); err == nil && major >= 20 {
+			args = append(args, "--experimental-permission", "--allow-fs-read="+f.Name())
+		}
+		verifier.args = append(args, f.Name())
+	})
+	return verifier.args, verifier.err
+}
+
+// verify loads the finished build to catch the errors at module evaluation time, the result
+// is stored in the module meta. Only the builds of browser targets are verified.
+func (task *BuildTask) verify(esm *ModuleMeta) {
+	if verifyOrigin == "" || esm == nil || esm.TypesOnly || (esm.Verification != nil && !isVerificationExpired(esm)) || len(task.Entries) > 0 || !isBrowserTarget(task.Target) {
+		return
+	}
+	if _, loaded := verifying.LoadOrStore(task.ID(), struct{}{}); loaded {
+		return
+	}
+	defer verifying.Delete(task.ID())
+
+	ret, err := verifyModule(fmt.Sprintf("%s%s/%s", verifyOrigin, basePath, task.ID()))
+	if err != nil {
+		log.Warnf("verify %s: %v", task.ID(), err)
+		return
+	}
+	// a timeout is not conclusive since the dependencies may be still in building
+	if ret.Timeout {
+		log.Warnf("verify %s: timeout", task.ID())
+		return
+	}
+	// the errors of the missing browser APIs in the sandbox and the dependencies that are not ready
+	// are not conclusive either
+	if ret.Inconclusive {
+		log.Warnf("verify %s: inconclusive: %s", task.ID(), ret.Error)
+		return
+	}
+	if ret.Error != "" {
+		log.Warnf("verify %s: %s", task.ID(), ret.Error)
+	}
+
+	// only the meta is updated, the working directory of the build is removed at this point,
+	// so going through `storeToDB` would record an empty lock
+	meta := *esm
+	meta.Verification = &ModuleVerification{Exports: ret.Exports, Error: ret.Error, Time: time.Now().Unix()}
+	if err := storeModuleMeta(task.ID(), &meta); err != nil {
+		log.Errorf("db: %v", err)
+	}
+}
+
+// isVerificationExpired checks whether the verification result of the module is expired
+func isVerificationExpired(esm *ModuleMeta) bool {
+	return esm.Verification != nil && time.Since(time.Unix(esm.Verification.Time, 0)) > verificationTTL
+}
+
+// getVerificationError returns the error of the module that is failed to load, the expired
+// result is ignored
+func getVerificationError(esm *ModuleMeta) error {
+	if esm.Verification != nil && esm.Verification.Error != "" && !isVerificationExpired(esm) {
+		return newServerError(ErrBuildFailed, "module evaluation failed: %s", esm.Verification.Error)
+	}
+	return nil
+}
+
+// clearVerification removes the verification result of the build, it's used by the admin API
+func clearVerification(id string) (ok bool, err error) {
+	esm, err := findModule(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	if esm.Verification != nil {
+		esm.Verification = nil
+		err = storeModuleMeta(id, esm)
+	}
+	return err == nil, err
+}
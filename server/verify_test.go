@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+)
+
+func TestVerificationExpiry(t *testing.T) {
+	esm := &ModuleMeta{Verification: &ModuleVerification{Error: "boom", Time: time.Now().Unix()}}
+	if getVerificationError(esm) == nil || isVerificationExpired(esm) {
+		t.Fatal("the fresh verification error should be served")
+	}
+	esm.Verification.Time = time.Now().Add(-verificationTTL - time.Minute).Unix()
+	if getVerificationError(esm) != nil || !isVerificationExpired(esm) {
+		t.Fatal("the expired verification error should be ignored")
+	}
+	// the results without time are stored before the expiry is introduced
+	esm.Verification.Time = 0
+	if getVerificationError(esm) != nil {
+		t.Fatal("the verification error without time should be ignored")
+	}
+}
+
+func TestVerifyModule(t *testing.T) {
+	if os.Getenv("CI") == "true" {
+		t.SkipNow()
+	}
+
+	modules := map[string]string{
+		"/a.js":   `import { b } from "./b.js"; export const a = b + 1; export default a;`,
+		"/b.js":   `export const b = window === self ? 1 : 0; setTimeout(() => { throw new Error("later") }, 0);`,
+		"/bad.js": `import "./b.js"; throw new Error("boom");`,
+		"/404.js": `import "./missing.js";`,
+		"/dom.js": `document.addEventListener("click", () => {}); const el = document.createElement("div"); el.style.color = "red";` +
+			`localStorage.setItem("k", "v"); addEventListener("resize", () => {});` +
+			`export const ua = navigator.userAgent, path = location.pathname, v = localStorage.getItem("k"), dark = matchMedia("(prefers-color-scheme: dark)").matches;` +
+			`export class El extends HTMLElement {}`,
+		"/canvas.js": `export const ctx = new OffscreenCanvas(1, 1);`,
+		"/node.js":   `export const env = process.env.NODE_ENV;`,
+		"/500.js":    `import "./building.js";`,
+		"/escape.js": `fetch.constructor.constructor("return process")().exit(1);`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, ok := modules[r.URL.Path]
+		if r.URL.Path == "/building.js" {
+			w.WriteHeader(500)
+			return
+		}
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(code))
+	}))
+	defer server.Close()
+
+	ret, err := verifyModule(server.URL + "/a.js")
+	if err != nil || ret.Error != "" || strings.Join(ret.Exports, ",") != "a,default" {
+		t.Fatalf("bad verification: %v %v", ret, err)
+	}
+	ret, err = verifyModule(server.URL + "/bad.js")
+	if err != nil || ret.Error != "boom" {
+		t.Fatalf("bad verification: %v %v", ret, err)
+	}
+	ret, err = verifyModule(server.URL + "/404.js")
+	if err != nil || !strings.Contains(ret.Error, "404") || ret.Inconclusive {
+		t.Fatalf("bad verification: %v %v", ret, err)
+	}
+	// the common DOM globals are stubbed
+	ret, err = verifyModule(server.URL + "/dom.js")
+	if err != nil || ret.Error != "" || strings.Join(ret.Exports, ",") != "El,dark,path,ua,v" {
+		t.Fatalf("bad verification: %v %v", ret, err)
+	}
+	// the missing browser APIs and the dependencies in building are not conclusive, but the node globals are
+	// the sandbox escape is blocked by disallowing the code generation from strings
+	for name, inconclusive := range map[string]bool{"/canvas.js": true, "/500.js": true, "/node.js": false, "/escape.js": true} {
+		ret, err = verifyModule(server.URL + name)
+		if err != nil || ret.Error == "" || ret.Inconclusive != inconclusive {
+			t.Fatalf("bad verification of %s: %v %v", name, ret, err)
+		}
+	}
+
+}
+
+func TestVerifyKeepsLock(t *testing.T) {
+	if os.Getenv("CI") == "true" {
+		t.SkipNow()
+	}
+
+	savedDB := db
+	defer func() { db = savedDB }()
+	var err error
+	db, err = storage.OpenDB(fmt.Sprintf("postdb:%s", path.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the build stores the lock with the installed tree of the working directory
+	wd := t.TempDir()
+	for dir, pkgJson := range map[string]string{
+		"node_modules/a": `{"name":"a","version":"1.0.0","dependencies":{"b":"^1.0.0"}}`,
+		"node_modules/b": `{"name":"b","version":"1.2.0"}`,
+	} {
+		ensureDir(path.Join(wd, dir))
+		if err := ioutil.WriteFile(path.Join(wd, dir, "package.json"), []byte(pkgJson), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task := &BuildTask{
+		BuildVersion: VERSION,
+		Pkg:          Pkg{Name: "a", Version: "1.0.0"},
+		Target:       "es2022",
+		wd:           wd,
+		lock:         newBuildLock(),
+	}
+	esm := &ModuleMeta{}
+	task.storeToDB(esm)
+	os.RemoveAll(wd)
+
+	// the working directory is removed before the verification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(`export const a = 1;`))
+	}))
+	defer server.Close()
+	savedOrigin := verifyOrigin
+	verifyOrigin = server.URL
+	defer func() { verifyOrigin = savedOrigin }()
+	task.verify(esm)
+
+	store, _, err := db.Get(task.ID())
+	if err != nil || !strings.Contains(store["meta"], `"v":{"exports":["a"]`) {
+		t.Fatalf("the verification should be stored: %v %v", store, err)
+	}
+	if lock := findBuildLock(task.ID()); lock.Resolutions["**/b"] != "1.2.0" {
+		t.Fatalf("the lock should keep its resolutions: %v", lock.Resolutions)
+	}
+}
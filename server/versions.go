@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/rex"
+)
+
+// PackageVersions defines the response of the `?versions` query
+type PackageVersions struct {
+	Name     string               `json:"name"`
+	Range    string               `json:"range,omitempty"`
+	DistTags map[string]string    `json:"distTags"`
+	Versions []PackageVersionInfo `json:"versions"`
+}
+
+type PackageVersionInfo struct {
+	Version    string `json:"version"`
+	Time       string `json:"time,omitempty"`
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// listPackageVersions returns the versions of the package that match the range in descending order,
+// the range can be a semver range or a dist-tag.
+func listPackageVersions(name string, versionRange string, before time.Time) (list *PackageVersions, err error) {
+	h, err := fetchPackageVersions(name)
+	if err != nil {
+		return
+	}
+
+	var vs []*semver.Version
+	if _, ok := h.DistTags[versionRange]; ok {
+		var version string
+		version, err = h.resolveDistTag(versionRange, before)
+		if err != nil {
+			return
+		}
+		if version != "" {
+			var v *semver.Version
+			v, err = semver.NewVersion(version)
+			if err != nil {
+				return
+			}
+			vs = []*semver.Version{v}
+		}
+	} else {
+		constraint := versionRange
+		if constraint == "" {
+			constraint = "*"
+		}
+		if _, e := semver.NewConstraint(constraint); e != nil {
+			err = newServerError(ErrBadRequest, "invalid version range '%s'", versionRange)
+			return
+		}
+		vs, err = h.matchVersions(constraint, before)
+		if err != nil {
+			return
+		}
+	}
+
+	// the dist-tags are resolved at the `before` time as well
+	distTags := h.DistTags
+	if !before.IsZero() {
+		distTags = map[string]string{}
+		for tag := range h.DistTags {
+			version, e := h.resolveDistTag(tag, before)
+			if e == nil && version != "" {
+				distTags[tag] = version
+			}
+		}
+	}
+
+	list = &PackageVersions{
+		Name:     name,
+		Range:    versionRange,
+		DistTags: distTags,
+		Versions: make([]PackageVersionInfo, len(vs)),
+	}
+	for i, v := range vs {
+		version := v.Original()
+		info := PackageVersionInfo{
+			Version: version,
+			Time:    h.Time[version],
+		}
+		switch d := h.Versions[version].Deprecated.(type) {
+		case string:
+			info.Deprecated = d
+		case bool:
+			if d {
+				info.Deprecated = "deprecated"
+			}
+		}
+		list.Versions[len(vs)-1-i] = info
+	}
+	return
+}
+
+// servePackageVersions serves the `/<pkg>@<range>?versions` query
+func servePackageVersions(ctx *rex.Context, pathname string, before time.Time) interface{} {
+	name, versionRange, _, err := splitPkgPath(pathname)
+	if err != nil {
+		return serveError(ctx, err)
+	}
+	list, err := listPackageVersions(name, versionRange, before)
+	if err != nil {
+		return serveError(ctx, err)
+	}
+	ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", 10*60))
+	return list
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+)
+
+func TestListPackageVersions(t *testing.T) {
+	var err error
+	cache, err = storage.OpenCache("memory:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &NpmPackageVerions{
+		DistTags: map[string]string{"latest": "1.1.0", "next": "2.0.0-beta.1", "broken": "x.y.z"},
+		Versions: map[string]NpmPackage{
+			"1.0.0":        {Version: "1.0.0"},
+			"1.1.0":        {Version: "1.1.0", Deprecated: "use 1.2"},
+			"2.0.0-beta.0": {Version: "2.0.0-beta.0"},
+			"2.0.0-beta.1": {Version: "2.0.0-beta.1"},
+			"x.y.z":        {Version: "x.y.z"},
+		},
+		Time: map[string]string{
+			"1.0.0":        "2022-01-01T00:00:00.000Z",
+			"1.1.0":        "2022-08-01T00:00:00.000Z",
+			"2.0.0-beta.0": "2022-08-15T00:00:00.000Z",
+			"2.0.0-beta.1": "2022-09-01T00:00:00.000Z",
+		},
+	}
+	cache.Set("npm:versions-test", utils.MustEncodeJSON(h), time.Hour)
+
+	list, err := listPackageVersions("versions-test", "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the malformed version of the registry is skipped
+	if len(list.Versions) != 2 || list.Versions[0].Version != "1.1.0" || list.Versions[0].Deprecated != "use 1.2" || list.Versions[1].Version != "1.0.0" {
+		t.Fatalf("bad versions: %v", list.Versions)
+	}
+	if len(list.DistTags) != 3 {
+		t.Fatalf("bad dist-tags: %v", list.DistTags)
+	}
+
+	list, err = listPackageVersions("versions-test", ">=2.0.0-0", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Versions) != 2 || list.Versions[0].Version != "2.0.0-beta.1" {
+		t.Fatalf("bad versions of the range: %v", list.Versions)
+	}
+
+	// the versions and the dist-tags are resolved at the `before` time
+	before := time.Date(2022, 8, 20, 0, 0, 0, 0, time.UTC)
+	list, err = listPackageVersions("versions-test", "*", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Versions) != 2 || list.Versions[0].Version != "1.1.0" {
+		t.Fatalf("bad versions before %v: %v", before, list.Versions)
+	}
+	if list.DistTags["latest"] != "1.1.0" || list.DistTags["next"] != "2.0.0-beta.0" {
+		t.Fatalf("bad dist-tags before %v: %v", before, list.DistTags)
+	}
+	list, err = listPackageVersions("versions-test", "next", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Versions) != 1 || list.Versions[0].Version != "2.0.0-beta.0" {
+		t.Fatalf("bad versions of the tag before %v: %v", before, list.Versions)
+	}
+	before = time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	list, err = listPackageVersions("versions-test", "latest", before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Versions) != 1 || list.Versions[0].Version != "1.0.0" || list.DistTags["latest"] != "1.0.0" {
+		t.Fatalf("bad latest version before %v: %v %v", before, list.Versions, list.DistTags)
+	}
+	if _, ok := list.DistTags["next"]; ok {
+		t.Fatalf("the tag published after %v should be removed: %v", before, list.DistTags)
+	}
+
+	// an invalid range is a bad request, a malformed tag of the registry is an internal error
+	if _, err = listPackageVersions("versions-test", ">=>1", time.Time{}); getErrorCode(err) != ErrBadRequest {
+		t.Fatalf("expected a bad request error, got %v", err)
+	}
+	if _, err = listPackageVersions("versions-test", "broken", time.Time{}); err == nil || getErrorCode(err) != ErrInternal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+}